@@ -3,6 +3,7 @@ package config
 import (
 	"encoding/json"
 	"testing"
+	"time"
 )
 
 func testOptions(opt Options, t *testing.T) {
@@ -66,3 +67,148 @@ func TestOptionsMerge(t *testing.T) {
 		t.Error("failed to find bad time intervals")
 	}
 }
+
+func TestOptionsMaintenance(t *testing.T) {
+	opts := DefaultOptions
+	opts.Relay.Maintenance.Start = "not-a-time"
+	if err := opts.Verify(); err == nil {
+		t.Error("failed to catch bad maintenance start")
+	}
+
+	opts.Relay.Maintenance.Start = "2019-06-01T12:00:00Z"
+	opts.Relay.Maintenance.End = "2019-06-01T11:00:00Z"
+	if err := opts.Verify(); err == nil {
+		t.Error("failed to catch maintenance ending before it starts")
+	}
+
+	opts.Relay.Maintenance.End = "2019-06-01T14:00:00Z"
+	if err := opts.Verify(); err != nil {
+		t.Error(err)
+	}
+
+	before, _ := time.Parse(time.RFC3339, "2019-06-01T11:30:00Z")
+	during, _ := time.Parse(time.RFC3339, "2019-06-01T13:00:00Z")
+	after, _ := time.Parse(time.RFC3339, "2019-06-01T15:00:00Z")
+
+	if opts.Relay.Maintenance.Active(before) {
+		t.Error("maintenance should not be active before the start")
+	} else if !opts.Relay.Maintenance.Active(during) {
+		t.Error("maintenance should be active during the window")
+	} else if opts.Relay.Maintenance.Active(after) {
+		t.Error("maintenance should not be active after the end")
+	}
+
+	opts.Relay.Maintenance.Enabled = true
+	if !opts.Relay.Maintenance.Active(before) {
+		t.Error("enabled maintenance should ignore the start time")
+	}
+}
+
+func TestOptionsTokens(t *testing.T) {
+	opts := DefaultOptions
+	opts.Relay.Tokens = []TokenOptions{{Token: ""}}
+	if err := opts.Verify(); err == nil {
+		t.Error("failed to catch empty token")
+	}
+
+	opts.Relay.Tokens = []TokenOptions{
+		{Token: "open"},
+		{Token: "scoped", AppIDs: []string{"lothar.com/wormhole/text-or-file-xfer"}},
+	}
+	if err := opts.Verify(); err != nil {
+		t.Error(err)
+	}
+
+	if !opts.Relay.Tokens[0].Allows("anything") {
+		t.Error("unscoped token should allow any app")
+	} else if !opts.Relay.Tokens[1].Allows("lothar.com/wormhole/text-or-file-xfer") {
+		t.Error("scoped token should allow its app")
+	} else if opts.Relay.Tokens[1].Allows("other") {
+		t.Error("scoped token should not allow other apps")
+	}
+}
+
+func TestOptionsApps(t *testing.T) {
+	opts := DefaultOptions
+	if !opts.Relay.AppAllowed("anything") {
+		t.Error("all apps should be allowed without an allowlist")
+	}
+
+	opts.Relay.AllowedApps = []string{"lothar.com/wormhole/text-or-file-xfer"}
+	if !opts.Relay.AppAllowed("lothar.com/wormhole/text-or-file-xfer") {
+		t.Error("listed app should be allowed")
+	} else if opts.Relay.AppAllowed("anything") {
+		t.Error("unlisted app should not be allowed")
+	}
+
+	opts.Relay.Apps = map[string]AppPolicy{
+		"bad": {NameplateStrategy: "backwards"},
+	}
+	if err := opts.Verify(); err == nil {
+		t.Error("failed to catch bad nameplate strategy")
+	}
+
+	opts.Relay.Apps = map[string]AppPolicy{
+		"bad": {ChannelExpiration: 1},
+	}
+	if err := opts.Verify(); err == nil {
+		t.Error("failed to catch policy expiration shorter than cleaning")
+	}
+
+	noList := false
+	opts.Relay.Apps = map[string]AppPolicy{
+		"lothar.com/wormhole/text-or-file-xfer": {AllowList: &noList, MaxMessages: 10, NameplateStrategy: NameplatesSequential},
+	}
+	if err := opts.Verify(); err != nil {
+		t.Error(err)
+	}
+
+	pol := opts.Relay.Policy("lothar.com/wormhole/text-or-file-xfer")
+	if *pol.AllowList || pol.MaxMessages != 10 || pol.NameplateStrategy != NameplatesSequential {
+		t.Errorf("policy overrides were not kept: %+v", pol)
+	}
+
+	pol = opts.Relay.Policy("other")
+	if *pol.AllowList != opts.Relay.AllowList || pol.NameplateStrategy != NameplatesRandom {
+		t.Errorf("policy defaults were not filled in: %+v", pol)
+	}
+}
+
+func TestOptionsDatabase(t *testing.T) {
+	opts := DefaultOptions
+	opts.Relay.Database.JournalMode = "wal"
+	if err := opts.Verify(); err != nil {
+		t.Error(err)
+	}
+
+	opts.Relay.Database.JournalMode = "journaled"
+	if err := opts.Verify(); err != ErrOptionsJournalMode {
+		t.Error("failed to catch bad journal mode")
+	}
+}
+
+func TestOptionsCluster(t *testing.T) {
+	opts := DefaultOptions
+	opts.Relay.Cluster.Bus = BusStorage
+	if err := opts.Verify(); err != nil {
+		t.Error(err)
+	}
+
+	opts.Relay.Cluster.Bus = "redis"
+	if err := opts.Verify(); err != ErrOptionsBus {
+		t.Error("failed to catch bad cluster bus")
+	}
+}
+
+func TestOptionsAdmin(t *testing.T) {
+	opts := DefaultOptions
+	opts.Relay.Admin.Port = 4002
+	if err := opts.Verify(); err != ErrOptionsAdminToken {
+		t.Error("failed to catch admin API without a token")
+	}
+
+	opts.Relay.Admin.Token = "secret"
+	if err := opts.Verify(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,39 @@
+package db
+
+import (
+	"errors"
+	"path/filepath"
+
+	"github.com/chris-pikul/go-wormhole-server/config"
+	"github.com/chris-pikul/go-wormhole-server/log"
+)
+
+//ErrBackupSelf is returned when the backup would overwrite the database
+var ErrBackupSelf = errors.New("backup file is the database file")
+
+//Backup copies the database into the file while the server may
+//still be running. How it is copied depends on the SQLite driver
+//the server was built with
+func Backup(dest string) error {
+	if config.Opts == nil {
+		panic("attempted to backup database without a configuration loaded")
+	}
+
+	if config.Opts.Relay.PostgresDSN != "" {
+		return ErrBackupPostgres
+	}
+
+	filename := config.Opts.Relay.DBFile
+	if a, err := filepath.Abs(filename); err == nil {
+		if b, err := filepath.Abs(dest); err == nil && a == b {
+			return ErrBackupSelf
+		}
+	}
+
+	if err := backup(filename, dest); err != nil {
+		return err
+	}
+
+	log.Infof("backed up database %s to %s", filename, dest)
+	return nil
+}
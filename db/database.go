@@ -1,20 +1,29 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"os"
-
-	//sqlite3 driver
-	_ "github.com/mattn/go-sqlite3"
+	"sync"
 
 	"github.com/chris-pikul/go-wormhole-server/config"
 	"github.com/chris-pikul/go-wormhole-server/log"
 )
 
-var db *sql.DB
+var (
+	db     *sql.DB
+	reader *sql.DB
+
+	stmts     map[string]*sql.Stmt
+	lockStmts sync.Mutex
+)
 
-//Initialize opens the necessary database connections for SQLite3
+//Initialize opens the necessary database connections, to PostgreSQL
+//if a DSN is configured, otherwise to the SQLite3 file.
+//For SQLite3 all writes are funneled through a single connection,
+//while reads can use a pool of read-only connections
 func Initialize() error {
 	if config.Opts == nil {
 		panic("attempted to initialize database without a configuration loaded")
@@ -22,6 +31,10 @@ func Initialize() error {
 
 	log.Info("initializing database")
 
+	if config.Opts.Relay.PostgresDSN != "" {
+		return initPostgres(config.Opts.Relay.PostgresDSN)
+	}
+
 	filename := config.Opts.Relay.DBFile
 	if filename == "" {
 		//If not running with file, then in memory should be used
@@ -36,35 +49,99 @@ func Initialize() error {
 		os.Create(filename)
 	}
 
+	opts := config.Opts.Relay.Database
+
 	var err error
-	db, err = sql.Open("sqlite3", filename)
+	db, err = sql.Open(driverName, dsn(filename, opts, false))
 	if err != nil {
 		return err
 	}
+	db.SetMaxOpenConns(1)
+	stmts = make(map[string]*sql.Stmt)
 	log.Infof("database connection opened to file %s", filename)
 
 	if createSchema {
-		return CreateSchema()
+		err = CreateSchema()
+	} else {
+		err = CheckMigration()
+	}
+	if err != nil {
+		return err
+	}
+
+	//Readers are opened once the schema, and journal mode, are in place
+	if opts.ReadConnections > 0 {
+		reader, err = sql.Open(driverName, dsn(filename, opts, true))
+		if err != nil {
+			return err
+		}
+		reader.SetMaxOpenConns(int(opts.ReadConnections))
+		log.Infof("opened pool of %d read connections", opts.ReadConnections)
 	}
 
-	//Check migration and return
-	return CheckMigration()
+	return nil
 }
 
 //Close terminates and clears the database connection
 func Close() {
 	log.Info("closing database connection")
+
+	lockStmts.Lock()
+	for _, stmt := range stmts {
+		stmt.Close()
+	}
+	stmts = nil
+	lockStmts.Unlock()
+
+	if reader != nil {
+		reader.Close()
+	}
+	reader = nil
+
 	if db != nil {
 		db.Close()
 	}
 	db = nil
+	shared = false
 }
 
-//Get returns the current database connection
+//Get returns the current database connection, which is
+//the only one that may write
 func Get() *sql.DB {
 	return db
 }
 
+//Reader returns the pool of read-only connections, or the
+//writer connection if there is no pool
+func Reader() *sql.DB {
+	if reader != nil {
+		return reader
+	}
+	return db
+}
+
+//Stmt returns the query prepared on the writer connection,
+//preparing it the first time and reusing it after that
+func Stmt(query string) (*sql.Stmt, error) {
+	if db == nil {
+		return nil, ErrNotOpen
+	}
+
+	lockStmts.Lock()
+	defer lockStmts.Unlock()
+
+	if stmt, ok := stmts[query]; ok {
+		return stmt, nil
+	}
+
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	stmts[query] = stmt
+	return stmt, nil
+}
+
 //CreateSchema sets up a new database schema for use
 func CreateSchema() error {
 	if db == nil {
@@ -110,10 +187,64 @@ func CheckMigration() error {
 		return errors.New("database schema version is higher then the binaries target")
 	} else if cur < schemaVersion {
 		log.Infof("updating db schema from %d to %d", cur, schemaVersion)
-		//TODO: Implement
+		for ver := cur + 1; ver <= schemaVersion; ver++ {
+			if err := migrate(ver); err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
 }
 
+//migrate upgrades the schema to the version, from the one
+//before it, within a transaction. Foreign keys are turned off
+//while tables are rebuilt, and checked before committing
+func migrate(ver int) error {
+	stmt, ok := migrations[ver]
+	if !ok {
+		return fmt.Errorf("no migration to database schema version %d", ver)
+	}
+
+	//Pragmas are per connection, and can't change within a transaction
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err = conn.ExecContext(ctx, `PRAGMA foreign_keys=OFF`); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, `PRAGMA foreign_keys=ON`)
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(stmt); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	var violations int
+	if err = tx.QueryRow(`SELECT COUNT(*) FROM pragma_foreign_key_check`).Scan(&violations); err != nil {
+		tx.Rollback()
+		return err
+	} else if violations > 0 {
+		tx.Rollback()
+		return fmt.Errorf("migrating to database schema version %d left %d foreign key violations", ver, violations)
+	}
+
+	if _, err = tx.Exec(`UPDATE version SET version=$1`, ver); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	log.Infof("migrated db schema to version %d", ver)
+	return tx.Commit()
+}
+
 var ErrNotOpen = errors.New("database connection is not open")
@@ -0,0 +1,283 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/chris-pikul/go-wormhole-server/config"
+)
+
+//schemaV2 is the relay schema before the constraints were added
+const schemaV2 = `
+CREATE TABLE version (version INTEGER NOT NULL);
+CREATE TABLE mailboxes (id VARCHAR PRIMARY KEY, app_id VARCHAR, updated INTEGER, for_nameplate BOOLEAN);
+CREATE TABLE mailbox_sides (mailbox_id VARCHAR REFERENCES mailboxes(id), opened BOOLEAN, side VARCHAR, added INTEGER, mood VARCHAR);
+CREATE TABLE messages (id VARCHAR, app_id VARCHAR, mailbox_id VARCHAR REFERENCES mailboxes(id), side VARCHAR,
+	phase VARCHAR, body VARCHAR, server_rx INTEGER, seq INTEGER);
+CREATE TABLE nameplates (id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL, app_id VARCHAR, name VARCHAR,
+	mailbox_id VARCHAR REFERENCES mailboxes(id), request_id VARCHAR DEFAULT '');
+CREATE TABLE nameplate_sides (nameplate_id INTEGER REFERENCES nameplates(id) NOT NULL, claimed BOOLEAN, side VARCHAR, added INTEGER);
+INSERT INTO version (version) VALUES (2);
+
+INSERT INTO mailboxes VALUES ('mb1', 'app', 0, true);
+INSERT INTO mailbox_sides VALUES ('mb1', true, 'side1', 0, NULL);
+INSERT INTO mailbox_sides VALUES ('mb1', true, 'side1', 0, NULL);
+INSERT INTO mailbox_sides VALUES ('gone', true, 'side1', 0, NULL);
+INSERT INTO messages VALUES ('m1', 'app', 'mb1', 'side1', 'pake', '00', 0, 1);
+INSERT INTO messages VALUES ('m2', 'app', 'gone', 'side1', 'pake', '00', 0, 1);
+INSERT INTO nameplates (app_id, name, mailbox_id) VALUES ('app', '4', 'mb1');
+INSERT INTO nameplates (app_id, name, mailbox_id) VALUES ('app', '4', 'mb1');
+INSERT INTO nameplate_sides VALUES (1, true, 'side1', 0);
+INSERT INTO nameplate_sides VALUES (2, true, 'side1', 0);
+`
+
+//schemaV1 is the relay schema before messages had a sequence
+const schemaV1 = `
+CREATE TABLE version (version INTEGER NOT NULL);
+CREATE TABLE mailboxes (id VARCHAR PRIMARY KEY, app_id VARCHAR, updated INTEGER, for_nameplate BOOLEAN);
+CREATE TABLE mailbox_sides (mailbox_id VARCHAR REFERENCES mailboxes(id), opened BOOLEAN, side VARCHAR, added INTEGER, mood VARCHAR);
+CREATE TABLE messages (id VARCHAR, app_id VARCHAR, mailbox_id VARCHAR REFERENCES mailboxes(id), side VARCHAR,
+	phase VARCHAR, body VARCHAR, server_rx INTEGER);
+CREATE TABLE nameplates (id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL, app_id VARCHAR, name VARCHAR,
+	mailbox_id VARCHAR REFERENCES mailboxes(id), request_id VARCHAR DEFAULT '');
+CREATE TABLE nameplate_sides (nameplate_id INTEGER REFERENCES nameplates(id) NOT NULL, claimed BOOLEAN, side VARCHAR, added INTEGER);
+INSERT INTO version (version) VALUES (1);
+
+INSERT INTO mailboxes VALUES ('mb1', 'app', 0, false);
+INSERT INTO mailboxes VALUES ('mb2', 'app', 0, false);
+INSERT INTO messages VALUES ('m1', 'app', 'mb1', 'side1', 'pake', '00', 30);
+INSERT INTO messages VALUES ('m2', 'app', 'mb2', 'side1', 'pake', '00', 20);
+INSERT INTO messages VALUES ('m3', 'app', 'mb1', 'side2', 'pake', '00', 10);
+`
+
+//initializeFile runs Initialize on the database file with the schema
+func initializeFile(t *testing.T, filename, schema string) {
+	old, err := sql.Open(driverName, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = old.Exec(schema)
+	old.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := config.DefaultOptions
+	opts.Relay.DBFile = filename
+	config.Opts = &opts
+
+	if err := Initialize(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateSequence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wormhole-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	initializeFile(t, filepath.Join(dir, "relay.db"), schemaV1)
+	defer Close()
+
+	//Existing messages are sequenced in the order they were added,
+	//whatever their received times say
+	expected := map[string]int64{"m1": 1, "m2": 2, "m3": 3}
+	for id, seq := range expected {
+		var got int64
+		if err := Get().QueryRow(`SELECT seq FROM messages WHERE id=$1`, id).Scan(&got); err != nil {
+			t.Fatal(err)
+		} else if got != seq {
+			t.Errorf("expected message %s to have sequence %d, found %d", id, seq, got)
+		}
+	}
+}
+
+func TestMigrateConstraints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wormhole-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	initializeFile(t, filepath.Join(dir, "relay.db"), schemaV2)
+	defer Close()
+
+	counts := map[string]int{
+		"mailboxes":       1,
+		"mailbox_sides":   1,
+		"messages":        1,
+		"nameplates":      1,
+		"nameplate_sides": 1,
+	}
+	for table, expected := range counts {
+		var n int
+		if err := Get().QueryRow(`SELECT COUNT(*) FROM ` + table).Scan(&n); err != nil {
+			t.Fatal(err)
+		} else if n != expected {
+			t.Errorf("expected %d rows in %s after migrating, found %d", expected, table, n)
+		}
+	}
+
+	_, err = Get().Exec(`INSERT INTO nameplates (app_id, name, mailbox_id) VALUES ('app', '4', 'mb1')`)
+	if err == nil {
+		t.Error("duplicate nameplate was allowed")
+	}
+
+	_, err = Get().Exec(`INSERT INTO messages (id, app_id, mailbox_id) VALUES ('m3', 'app', 'gone')`)
+	if err == nil {
+		t.Error("message for a missing mailbox was allowed")
+	}
+
+	//Deleting the mailbox takes everything with it
+	if _, err := Get().Exec(`DELETE FROM mailboxes WHERE id='mb1'`); err != nil {
+		t.Fatal(err)
+	}
+	var remaining int
+	Get().QueryRow(`SELECT (SELECT COUNT(*) FROM mailbox_sides) + (SELECT COUNT(*) FROM messages)
+		+ (SELECT COUNT(*) FROM nameplates) + (SELECT COUNT(*) FROM nameplate_sides)`).Scan(&remaining)
+	if remaining != 0 {
+		t.Errorf("expected deletes to cascade, %d rows remain", remaining)
+	}
+}
+
+//schemaOf returns the CREATE statements of the database, keyed by name.
+//Whitespace is left out, as the old schemas here are written compactly
+func schemaOf(t *testing.T) map[string]string {
+	rows, err := Get().Query(`SELECT name, sql FROM sqlite_master WHERE sql IS NOT NULL`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	schema := make(map[string]string)
+	for rows.Next() {
+		var name, stmt string
+		if err := rows.Scan(&name, &stmt); err != nil {
+			t.Fatal(err)
+		}
+		schema[name] = strings.Join(strings.Fields(stmt), "")
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return schema
+}
+
+func TestMigrateToCurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wormhole-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	openTestDB(t, dir, "fresh.db")
+	fresh := schemaOf(t)
+	Close()
+
+	//Every migration is run, one after the other
+	initializeFile(t, filepath.Join(dir, "relay.db"), schemaV1)
+	defer Close()
+
+	var version int
+	if err := Get().QueryRow(`SELECT version FROM version`).Scan(&version); err != nil {
+		t.Fatal(err)
+	} else if version != schemaVersion {
+		t.Errorf("expected schema version %d after migrating, found %d", schemaVersion, version)
+	}
+
+	upgraded := schemaOf(t)
+	for name, stmt := range fresh {
+		if upgraded[name] != stmt {
+			t.Errorf("migrated %s differs from a new database:\n%s\nexpected:\n%s", name, upgraded[name], stmt)
+		}
+	}
+	for name := range upgraded {
+		if _, ok := fresh[name]; !ok {
+			t.Errorf("migrating left %s, which a new database does not have", name)
+		}
+	}
+
+	var messages int
+	if err := Get().QueryRow(`SELECT COUNT(*) FROM messages`).Scan(&messages); err != nil {
+		t.Fatal(err)
+	} else if messages != 3 {
+		t.Errorf("expected the 3 messages to survive migrating, found %d", messages)
+	}
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wormhole-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := config.DefaultOptions
+	opts.Relay.DBFile = filepath.Join(dir, "relay.db")
+	opts.Relay.Database = config.DatabaseOptions{
+		JournalMode:     "wal",
+		BusyTimeout:     5000,
+		ReadConnections: 4,
+	}
+	config.Opts = &opts
+
+	if err := Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	defer Close()
+
+	var mode string
+	if err := Get().QueryRow(`PRAGMA journal_mode`).Scan(&mode); err != nil {
+		t.Fatal(err)
+	} else if mode != "wal" {
+		t.Errorf("expected the wal journal mode, found %s", mode)
+	}
+
+	//Writers share the one connection while readers keep reading,
+	//none of them should find the database locked
+	const workers, writes = 8, 25
+	failures := make(chan error, workers*writes*2)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				stmt, err := Stmt(`INSERT INTO mailboxes (id, app_id, updated, for_nameplate) VALUES ($1, $2, $3, $4)`)
+				if err != nil {
+					failures <- err
+					return
+				}
+				if _, err := stmt.Exec(fmt.Sprintf("mb%d-%d", w, i), "app", i, false); err != nil {
+					failures <- err
+				}
+
+				var n int
+				if err := Reader().QueryRow(`SELECT COUNT(*) FROM mailboxes`).Scan(&n); err != nil {
+					failures <- err
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(failures)
+
+	for err := range failures {
+		t.Error(err)
+	}
+
+	var n int
+	if err := Reader().QueryRow(`SELECT COUNT(*) FROM mailboxes`).Scan(&n); err != nil {
+		t.Fatal(err)
+	} else if n != workers*writes {
+		t.Errorf("expected %d mailboxes, found %d", workers*writes, n)
+	}
+}
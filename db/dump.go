@@ -0,0 +1,291 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/chris-pikul/go-wormhole-server/log"
+)
+
+//dumpVersion is the version of the dump format written by Export
+const dumpVersion = 1
+
+//Dump is the portable form of the relay data, as written by Export
+//and loaded by Import. It does not depend on the schema, so it can be
+//loaded into a database of a later version
+type Dump struct {
+	Version    int             `json:"version"`
+	Exported   int64           `json:"exported"`
+	Mailboxes  []DumpMailbox   `json:"mailboxes"`
+	Nameplates []DumpNameplate `json:"nameplates"`
+}
+
+//DumpMailbox is a mailbox along with its sides and messages
+type DumpMailbox struct {
+	ID           string            `json:"id"`
+	AppID        string            `json:"appID"`
+	Updated      int64             `json:"updated"`
+	ForNameplate bool              `json:"forNameplate"`
+	Sides        []DumpMailboxSide `json:"sides"`
+	Messages     []DumpMessage     `json:"messages"`
+}
+
+//DumpMailboxSide is a side that opened a mailbox
+type DumpMailboxSide struct {
+	Side   string `json:"side"`
+	Opened bool   `json:"opened"`
+	Added  int64  `json:"added"`
+	Mood   string `json:"mood,omitempty"`
+}
+
+//DumpMessage is a message added to a mailbox
+type DumpMessage struct {
+	ID       string  `json:"id"`
+	Side     string  `json:"side"`
+	Phase    string  `json:"phase"`
+	Body     string  `json:"body"`
+	ServerRX float64 `json:"serverRX"`
+	Seq      int64   `json:"seq"`
+}
+
+//DumpNameplate is a nameplate along with the sides that claimed it
+type DumpNameplate struct {
+	AppID     string              `json:"appID"`
+	Name      string              `json:"name"`
+	MailboxID string              `json:"mailboxID"`
+	RequestID string              `json:"requestID,omitempty"`
+	Sides     []DumpNameplateSide `json:"sides"`
+}
+
+//DumpNameplateSide is a side that claimed a nameplate
+type DumpNameplateSide struct {
+	Side    string `json:"side"`
+	Claimed bool   `json:"claimed"`
+	Added   int64  `json:"added"`
+}
+
+//Export reads all of the relay data into a Dump, within a single
+//read transaction so it is consistent while the server runs
+func Export() (*Dump, error) {
+	if db == nil {
+		return nil, ErrNotOpen
+	}
+
+	tx, err := Reader().Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	dump := &Dump{
+		Version:    dumpVersion,
+		Exported:   time.Now().Unix(),
+		Mailboxes:  make([]DumpMailbox, 0),
+		Nameplates: make([]DumpNameplate, 0),
+	}
+
+	mailboxes := make(map[string]*DumpMailbox)
+	err = queryEach(tx, `SELECT id, app_id, updated, for_nameplate FROM mailboxes ORDER BY updated, id`, func(rows *sql.Rows) error {
+		mb := DumpMailbox{
+			Sides:    make([]DumpMailboxSide, 0),
+			Messages: make([]DumpMessage, 0),
+		}
+		if err := rows.Scan(&mb.ID, &mb.AppID, &mb.Updated, &mb.ForNameplate); err != nil {
+			return err
+		}
+		dump.Mailboxes = append(dump.Mailboxes, mb)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range dump.Mailboxes {
+		mailboxes[dump.Mailboxes[i].ID] = &dump.Mailboxes[i]
+	}
+
+	err = queryEach(tx, `SELECT mailbox_id, side, opened, added, mood FROM mailbox_sides ORDER BY mailbox_id, added, side`, func(rows *sql.Rows) error {
+		var id string
+		var mood sql.NullString
+		side := DumpMailboxSide{}
+		if err := rows.Scan(&id, &side.Side, &side.Opened, &side.Added, &mood); err != nil {
+			return err
+		}
+		side.Mood = mood.String
+		if mb, ok := mailboxes[id]; ok {
+			mb.Sides = append(mb.Sides, side)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = queryEach(tx, `SELECT mailbox_id, id, side, phase, body, server_rx, seq FROM messages ORDER BY mailbox_id, seq`, func(rows *sql.Rows) error {
+		var id string
+		m := DumpMessage{}
+		if err := rows.Scan(&id, &m.ID, &m.Side, &m.Phase, &m.Body, &m.ServerRX, &m.Seq); err != nil {
+			return err
+		}
+		if mb, ok := mailboxes[id]; ok {
+			mb.Messages = append(mb.Messages, m)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	nameplates := make(map[int64]int)
+	err = queryEach(tx, `SELECT id, app_id, name, mailbox_id, request_id FROM nameplates ORDER BY id`, func(rows *sql.Rows) error {
+		var id int64
+		var reqID sql.NullString
+		np := DumpNameplate{Sides: make([]DumpNameplateSide, 0)}
+		if err := rows.Scan(&id, &np.AppID, &np.Name, &np.MailboxID, &reqID); err != nil {
+			return err
+		}
+		np.RequestID = reqID.String
+		nameplates[id] = len(dump.Nameplates)
+		dump.Nameplates = append(dump.Nameplates, np)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = queryEach(tx, `SELECT nameplate_id, side, claimed, added FROM nameplate_sides ORDER BY nameplate_id, added, side`, func(rows *sql.Rows) error {
+		var id int64
+		side := DumpNameplateSide{}
+		if err := rows.Scan(&id, &side.Side, &side.Claimed, &side.Added); err != nil {
+			return err
+		}
+		if i, ok := nameplates[id]; ok {
+			dump.Nameplates[i].Sides = append(dump.Nameplates[i].Sides, side)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("exported %d mailboxes and %d nameplates", len(dump.Mailboxes), len(dump.Nameplates))
+	return dump, nil
+}
+
+//ExportTo writes the relay data as JSON
+func ExportTo(w io.Writer) error {
+	dump, err := Export()
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(dump)
+}
+
+//Import loads the dump into the database within a single transaction.
+//Nothing is loaded if any of it conflicts with what is already there
+func Import(dump *Dump) error {
+	if db == nil {
+		return ErrNotOpen
+	}
+	if dump.Version != dumpVersion {
+		return fmt.Errorf("unsupported dump version %d, expected %d", dump.Version, dumpVersion)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := importDump(tx, dump); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Infof("imported %d mailboxes and %d nameplates", len(dump.Mailboxes), len(dump.Nameplates))
+	return nil
+}
+
+//ImportFrom reads a JSON dump and loads it into the database
+func ImportFrom(r io.Reader) error {
+	dump := Dump{}
+	if err := json.NewDecoder(r).Decode(&dump); err != nil {
+		return err
+	}
+	return Import(&dump)
+}
+
+func importDump(tx *sql.Tx, dump *Dump) error {
+	for _, mb := range dump.Mailboxes {
+		_, err := tx.Exec(`INSERT INTO mailboxes (id, app_id, updated, for_nameplate) VALUES ($1, $2, $3, $4)`,
+			mb.ID, mb.AppID, mb.Updated, mb.ForNameplate)
+		if err != nil {
+			return fmt.Errorf("importing mailbox %s: %s", mb.ID, err)
+		}
+
+		for _, side := range mb.Sides {
+			_, err := tx.Exec(`INSERT INTO mailbox_sides (mailbox_id, opened, side, added, mood) VALUES ($1, $2, $3, $4, $5)`,
+				mb.ID, side.Opened, side.Side, side.Added, sql.NullString{String: side.Mood, Valid: side.Mood != ""})
+			if err != nil {
+				return fmt.Errorf("importing side %s of mailbox %s: %s", side.Side, mb.ID, err)
+			}
+		}
+
+		for _, m := range mb.Messages {
+			_, err := tx.Exec(`INSERT INTO messages (id, app_id, mailbox_id, side, phase, body, server_rx, seq)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`, m.ID, mb.AppID, mb.ID, m.Side, m.Phase, m.Body, m.ServerRX, m.Seq)
+			if err != nil {
+				return fmt.Errorf("importing message %s of mailbox %s: %s", m.ID, mb.ID, err)
+			}
+		}
+	}
+
+	for _, np := range dump.Nameplates {
+		_, err := tx.Exec(`INSERT INTO nameplates (app_id, name, mailbox_id, request_id) VALUES ($1, $2, $3, $4)`,
+			np.AppID, np.Name, np.MailboxID, np.RequestID)
+		if err != nil {
+			return fmt.Errorf("importing nameplate %s of application %s: %s", np.Name, np.AppID, err)
+		}
+
+		//Not every driver has the last insert ID, the name is unique though
+		var npid int64
+		row := tx.QueryRow(`SELECT id FROM nameplates WHERE app_id=$1 AND name=$2`, np.AppID, np.Name)
+		if err := row.Scan(&npid); err != nil {
+			return err
+		}
+
+		for _, side := range np.Sides {
+			_, err := tx.Exec(`INSERT INTO nameplate_sides (nameplate_id, claimed, side, added) VALUES ($1, $2, $3, $4)`,
+				npid, side.Claimed, side.Side, side.Added)
+			if err != nil {
+				return fmt.Errorf("importing side %s of nameplate %s: %s", side.Side, np.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+//queryEach runs the query in the transaction and calls fn for each row
+func queryEach(tx *sql.Tx, query string, fn func(*sql.Rows) error) error {
+	rows, err := tx.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := fn(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"bytes"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/chris-pikul/go-wormhole-server/config"
+)
+
+const testData = `
+INSERT INTO mailboxes VALUES ('mb1', 'app', 100, true);
+INSERT INTO mailbox_sides VALUES ('mb1', true, 'side1', 100, NULL);
+INSERT INTO mailbox_sides VALUES ('mb1', false, 'side2', 101, 'happy');
+INSERT INTO messages VALUES ('m1', 'app', 'mb1', 'side1', 'pake', '00', 100.5, 1);
+INSERT INTO messages VALUES ('m2', 'app', 'mb1', 'side2', 'pake', '01', 101.5, 2);
+INSERT INTO nameplates (app_id, name, mailbox_id) VALUES ('app', '4', 'mb1');
+INSERT INTO nameplate_sides VALUES (1, true, 'side1', 100);
+`
+
+//openTestDB initializes a fresh database file in the directory
+func openTestDB(t *testing.T, dir, name string) string {
+	opts := config.DefaultOptions
+	opts.Relay.DBFile = filepath.Join(dir, name)
+	config.Opts = &opts
+
+	if err := Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	return opts.Relay.DBFile
+}
+
+func TestExportImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wormhole-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	openTestDB(t, dir, "from.db")
+	if _, err := Get().Exec(testData); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := ExportTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	exported, _ := Export()
+	Close()
+
+	openTestDB(t, dir, "to.db")
+	defer Close()
+	if err := ImportFrom(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	imported, err := Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported.Exported = exported.Exported
+	if !reflect.DeepEqual(exported, imported) {
+		t.Errorf("imported data differs from the export\nexpected %+v\ngot %+v", exported, imported)
+	}
+
+	//Loading it again conflicts, and leaves nothing behind
+	if err := ImportFrom(bytes.NewReader(buf.Bytes())); err == nil {
+		t.Error("importing over existing data should fail")
+	}
+	var nameplates int
+	Get().QueryRow(`SELECT COUNT(*) FROM nameplates`).Scan(&nameplates)
+	if nameplates != 1 {
+		t.Errorf("failed import should be rolled back, found %d nameplates", nameplates)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wormhole-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := openTestDB(t, dir, "relay.db")
+	defer Close()
+	if _, err := Get().Exec(testData); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Backup(filename); err != ErrBackupSelf {
+		t.Errorf("expected backing up over the database to be refused, got %v", err)
+	}
+
+	dest := filepath.Join(dir, "backup.db")
+	if err := Backup(dest); err != nil {
+		t.Fatal(err)
+	}
+
+	bk, err := sql.Open(driverName, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bk.Close()
+
+	var messages int
+	if err := bk.QueryRow(`SELECT COUNT(*) FROM messages`).Scan(&messages); err != nil {
+		t.Fatal(err)
+	} else if messages != 2 {
+		t.Errorf("expected 2 messages in the backup, found %d", messages)
+	}
+}
@@ -0,0 +1,119 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	//postgres driver
+	_ "github.com/lib/pq"
+
+	"github.com/chris-pikul/go-wormhole-server/log"
+)
+
+//postgresLock is the advisory lock held while setting up the schema,
+//so relays starting together against an empty database take turns
+const postgresLock = 0x776f726d //"worm"
+
+//ErrBackupPostgres is returned when backing up a PostgreSQL database
+var ErrBackupPostgres = errors.New("backup only copies SQLite databases, use pg_dump for PostgreSQL")
+
+//shared is true when the database can be used by several relays at once
+var shared bool
+
+//Shared returns true if the database may be shared with other relay
+//processes, so the state in it is not just left over from the last run
+func Shared() bool {
+	return shared
+}
+
+//initPostgres connects to the PostgreSQL database, and sets up or
+//migrates its schema. The connection pool is used for both reads
+//and writes
+func initPostgres(dsn string) error {
+	var err error
+	db, err = sql.Open("postgres", dsn)
+	if err != nil {
+		return err
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		db = nil
+		return err
+	}
+	stmts = make(map[string]*sql.Stmt)
+	shared = true
+	log.Info("database connection opened to PostgreSQL")
+
+	return setupPostgres()
+}
+
+//setupPostgres creates the schema if the database is empty,
+//or migrates it to the current version, in one transaction
+func setupPostgres() error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err = setupPostgresTx(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func setupPostgresTx(tx *sql.Tx) error {
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, postgresLock); err != nil {
+		return err
+	}
+
+	var exists bool
+	row := tx.QueryRow(`SELECT COUNT(*)>0 FROM information_schema.tables
+		WHERE table_schema=current_schema() AND table_name='version'`)
+	if err := row.Scan(&exists); err != nil {
+		return err
+	}
+
+	if !exists {
+		log.Info("setting up database schema")
+		if _, err := tx.Exec(postgresSchema); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO version (version) VALUES ($1)`, postgresSchemaVersion); err != nil {
+			return err
+		}
+
+		log.Infof("set schema version to %d", postgresSchemaVersion)
+		return nil
+	}
+
+	var cur int
+	if err := tx.QueryRow(`SELECT version FROM version`).Scan(&cur); err != nil {
+		if err == sql.ErrNoRows {
+			return errors.New("could not find the schema version of the database, it may be corrupt")
+		}
+		return err
+	}
+
+	if cur > postgresSchemaVersion {
+		return errors.New("database schema version is higher then the binaries target")
+	}
+
+	for ver := cur + 1; ver <= postgresSchemaVersion; ver++ {
+		stmt, ok := postgresMigrations[ver]
+		if !ok {
+			return fmt.Errorf("no migration to database schema version %d", ver)
+		}
+
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE version SET version=$1`, ver); err != nil {
+			return err
+		}
+		log.Infof("migrated db schema to version %d", ver)
+	}
+
+	return nil
+}
@@ -0,0 +1,265 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/chris-pikul/go-wormhole-server/log"
+)
+
+//pythonUsageTables are the usage tables of the Python server. This
+//server writes usage to the logs instead, so they are not imported
+var pythonUsageTables = []string{"nameplate_usage", "mailbox_usage"}
+
+//PythonReport describes what was read from a Python mailbox server
+//database, and anything that could not be imported
+type PythonReport struct {
+	//Version is the schema version of the Python database
+	Version int
+
+	Mailboxes  int
+	Nameplates int
+	Messages   int
+
+	//Usage counts the rows of each usage table that were skipped
+	Usage map[string]int
+
+	//Skipped lists the rows that were dropped, and why
+	Skipped []string
+}
+
+//skip records a row that was dropped
+func (r *PythonReport) skip(format string, args ...interface{}) {
+	r.Skipped = append(r.Skipped, fmt.Sprintf(format, args...))
+}
+
+//ReadPython reads the database file of the Python
+//magic-wormhole-mailbox-server into a Dump, which Import can then load.
+//Rows that don't fit this server's schema, such as messages for
+//missing mailboxes or duplicate nameplates, are left out and listed
+//in the report
+func ReadPython(filename string) (*Dump, *PythonReport, error) {
+	src, err := sql.Open(driverName, "file:"+filename+"?mode=ro")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer src.Close()
+
+	tx, err := src.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	report := &PythonReport{
+		Usage:   make(map[string]int),
+		Skipped: make([]string, 0),
+	}
+	if err := tx.QueryRow(`SELECT version FROM version`).Scan(&report.Version); err != nil {
+		return nil, nil, fmt.Errorf("reading Python database version: %s", err)
+	}
+
+	dump := &Dump{
+		Version:    dumpVersion,
+		Exported:   time.Now().Unix(),
+		Mailboxes:  make([]DumpMailbox, 0),
+		Nameplates: make([]DumpNameplate, 0),
+	}
+
+	mailboxes := make(map[string]int)
+	err = queryEach(tx, `SELECT app_id, id, updated, for_nameplate FROM mailboxes ORDER BY rowid`, func(rows *sql.Rows) error {
+		var updated sql.NullInt64
+		var forNameplate sql.NullBool
+		mb := DumpMailbox{
+			Sides:    make([]DumpMailboxSide, 0),
+			Messages: make([]DumpMessage, 0),
+		}
+		if err := rows.Scan(&mb.AppID, &mb.ID, &updated, &forNameplate); err != nil {
+			return err
+		}
+
+		if _, ok := mailboxes[mb.ID]; ok {
+			report.skip("mailbox %s: duplicate mailbox", mb.ID)
+			return nil
+		}
+		mb.Updated = updated.Int64
+		mb.ForNameplate = forNameplate.Bool
+
+		mailboxes[mb.ID] = len(dump.Mailboxes)
+		dump.Mailboxes = append(dump.Mailboxes, mb)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = queryEach(tx, `SELECT mailbox_id, opened, side, added, mood FROM mailbox_sides ORDER BY rowid`, func(rows *sql.Rows) error {
+		var id string
+		var opened sql.NullBool
+		var added sql.NullInt64
+		var mood sql.NullString
+		side := DumpMailboxSide{}
+		if err := rows.Scan(&id, &opened, &side.Side, &added, &mood); err != nil {
+			return err
+		}
+
+		i, ok := mailboxes[id]
+		if !ok {
+			report.skip("side %s of mailbox %s: mailbox does not exist", side.Side, id)
+			return nil
+		}
+		for _, s := range dump.Mailboxes[i].Sides {
+			if s.Side == side.Side {
+				report.skip("side %s of mailbox %s: duplicate side", side.Side, id)
+				return nil
+			}
+		}
+		side.Opened = opened.Bool
+		side.Added = added.Int64
+		side.Mood = mood.String
+
+		dump.Mailboxes[i].Sides = append(dump.Mailboxes[i].Sides, side)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	//Messages are sequenced in the order the server received them
+	err = queryEach(tx, `SELECT mailbox_id, msg_id, side, phase, body, server_rx FROM messages
+		ORDER BY server_rx, rowid`, func(rows *sql.Rows) error {
+		var id string
+		var msgID sql.NullString
+		m := DumpMessage{}
+		if err := rows.Scan(&id, &msgID, &m.Side, &m.Phase, &m.Body, &m.ServerRX); err != nil {
+			return err
+		}
+		m.ID = msgID.String
+
+		i, ok := mailboxes[id]
+		if !ok {
+			report.skip("message %s of mailbox %s: mailbox does not exist", m.ID, id)
+			return nil
+		}
+		m.Seq = int64(len(dump.Mailboxes[i].Messages) + 1)
+
+		dump.Mailboxes[i].Messages = append(dump.Mailboxes[i].Messages, m)
+		report.Messages++
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nameplates := make(map[int64]int)
+	names := make(map[string]bool)
+	err = queryEach(tx, `SELECT id, app_id, name, mailbox_id, request_id FROM nameplates ORDER BY id`, func(rows *sql.Rows) error {
+		var id int64
+		var mbid, reqID sql.NullString
+		np := DumpNameplate{Sides: make([]DumpNameplateSide, 0)}
+		if err := rows.Scan(&id, &np.AppID, &np.Name, &mbid, &reqID); err != nil {
+			return err
+		}
+		np.MailboxID = mbid.String
+		np.RequestID = reqID.String
+
+		if _, ok := mailboxes[np.MailboxID]; !ok {
+			report.skip("nameplate %s of application %s: mailbox %s does not exist", np.Name, np.AppID, np.MailboxID)
+			return nil
+		} else if names[np.AppID+"/"+np.Name] {
+			report.skip("nameplate %s of application %s: duplicate nameplate", np.Name, np.AppID)
+			return nil
+		}
+		names[np.AppID+"/"+np.Name] = true
+
+		nameplates[id] = len(dump.Nameplates)
+		dump.Nameplates = append(dump.Nameplates, np)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	//The Python server names this column after the plural table
+	err = queryEach(tx, `SELECT nameplates_id, claimed, side, added FROM nameplate_sides ORDER BY rowid`, func(rows *sql.Rows) error {
+		var id int64
+		var claimed sql.NullBool
+		var added sql.NullInt64
+		side := DumpNameplateSide{}
+		if err := rows.Scan(&id, &claimed, &side.Side, &added); err != nil {
+			return err
+		}
+
+		i, ok := nameplates[id]
+		if !ok {
+			report.skip("side %s of nameplate %d: nameplate was not imported", side.Side, id)
+			return nil
+		}
+		for _, s := range dump.Nameplates[i].Sides {
+			if s.Side == side.Side {
+				report.skip("side %s of nameplate %s: duplicate side", side.Side, dump.Nameplates[i].Name)
+				return nil
+			}
+		}
+		side.Claimed = claimed.Bool
+		side.Added = added.Int64
+
+		dump.Nameplates[i].Sides = append(dump.Nameplates[i].Sides, side)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, table := range pythonUsageTables {
+		var exists bool
+		tx.QueryRow(`SELECT COUNT(*)>0 FROM sqlite_master WHERE type='table' AND name=$1`, table).Scan(&exists)
+		if !exists {
+			continue
+		}
+
+		var n int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM ` + table).Scan(&n); err != nil {
+			return nil, nil, err
+		}
+		report.Usage[table] = n
+	}
+
+	report.Mailboxes = len(dump.Mailboxes)
+	report.Nameplates = len(dump.Nameplates)
+	return dump, report, nil
+}
+
+//ImportPython reads the Python mailbox server database file and
+//imports it into this database, logging the report of what was skipped
+func ImportPython(filename string) (*PythonReport, error) {
+	dump, report, err := ReadPython(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := Import(dump); err != nil {
+		return report, err
+	}
+
+	log.Infof("imported %d mailboxes, %d nameplates and %d messages from Python database version %d",
+		report.Mailboxes, report.Nameplates, report.Messages, report.Version)
+
+	tables := make([]string, 0, len(report.Usage))
+	for table := range report.Usage {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		if report.Usage[table] > 0 {
+			log.Warnf("skipped %d rows of %s, usage is only written to the logs", report.Usage[table], table)
+		}
+	}
+
+	for _, skipped := range report.Skipped {
+		log.Warnf("skipped %s", skipped)
+	}
+	return report, nil
+}
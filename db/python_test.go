@@ -0,0 +1,86 @@
+package db
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//pythonSchema is the channel database of magic-wormhole-mailbox-server
+const pythonSchema = `
+CREATE TABLE version (version INTEGER);
+CREATE TABLE nameplates (id INTEGER PRIMARY KEY AUTOINCREMENT, app_id VARCHAR, name VARCHAR,
+	mailbox_id VARCHAR REFERENCES mailboxes(id), request_id VARCHAR);
+CREATE TABLE nameplate_sides (nameplates_id REFERENCES nameplates(id), claimed BOOLEAN, side VARCHAR, added INTEGER);
+CREATE TABLE mailboxes (app_id VARCHAR, id VARCHAR, updated INTEGER, for_nameplate BOOLEAN);
+CREATE TABLE mailbox_sides (mailbox_id REFERENCES mailboxes(id), opened BOOLEAN, side VARCHAR, added INTEGER, mood VARCHAR);
+CREATE TABLE messages (app_id VARCHAR, mailbox_id VARCHAR, side VARCHAR, phase VARCHAR, body VARCHAR,
+	server_rx INTEGER, msg_id VARCHAR);
+CREATE TABLE nameplate_usage (app_id VARCHAR, started INTEGER, waiting_time INTEGER, total_time INTEGER, result VARCHAR);
+CREATE TABLE mailbox_usage (app_id VARCHAR, for_nameplate BOOLEAN, started INTEGER, total_time INTEGER,
+	waiting_time INTEGER, result VARCHAR);
+INSERT INTO version VALUES (1);
+
+INSERT INTO mailboxes VALUES ('app', 'mb1', 100, 1);
+INSERT INTO mailbox_sides VALUES ('mb1', 1, 'side1', 100, NULL);
+INSERT INTO mailbox_sides VALUES ('gone', 1, 'side1', 100, NULL);
+INSERT INTO messages VALUES ('app', 'mb1', 'side1', 'version', '01', 101.5, 'm2');
+INSERT INTO messages VALUES ('app', 'mb1', 'side1', 'pake', '00', 100.5, 'm1');
+INSERT INTO messages VALUES ('app', 'gone', 'side1', 'pake', '00', 100.5, 'm3');
+INSERT INTO nameplates (app_id, name, mailbox_id, request_id) VALUES ('app', '4', 'mb1', NULL);
+INSERT INTO nameplates (app_id, name, mailbox_id, request_id) VALUES ('app', '4', 'mb1', NULL);
+INSERT INTO nameplate_sides VALUES (1, 1, 'side1', 100);
+INSERT INTO nameplate_sides VALUES (2, 1, 'side2', 100);
+INSERT INTO mailbox_usage VALUES ('app', 1, 50, 10, 5, 'happy');
+`
+
+func TestImportPython(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wormhole-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "relay.sqlite")
+	py, err := sql.Open(driverName, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = py.Exec(pythonSchema)
+	py.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	openTestDB(t, dir, "relay.db")
+	defer Close()
+
+	report, err := ImportPython(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Version != 1 || report.Mailboxes != 1 || report.Nameplates != 1 || report.Messages != 2 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if len(report.Skipped) != 4 {
+		t.Errorf("expected 4 skipped rows, got %q", report.Skipped)
+	}
+	if report.Usage["mailbox_usage"] != 1 {
+		t.Errorf("expected the usage row to be reported, got %v", report.Usage)
+	}
+
+	var first string
+	Get().QueryRow(`SELECT id FROM messages WHERE mailbox_id='mb1' AND seq=1`).Scan(&first)
+	if first != "m1" {
+		t.Errorf("expected messages to be sequenced by when they were received, first was %q", first)
+	}
+
+	var sides int
+	Get().QueryRow(`SELECT COUNT(*) FROM nameplate_sides`).Scan(&sides)
+	if sides != 1 {
+		t.Errorf("expected the side of the duplicate nameplate to be dropped, found %d sides", sides)
+	}
+}
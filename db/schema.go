@@ -1,12 +1,16 @@
 package db
 
-const schemaVersion = 1
+const schemaVersion = 4
 
 const relaySchema = `
 CREATE TABLE version (
 	version INTEGER NOT NULL
 );
+` + relayTables + relayIndexes + eventTables
 
+//relayTables creates the relay data tables. The unique constraints
+//and cascading deletes are only enforced with foreign keys turned on
+const relayTables = `
 -- Relay data
 
 CREATE TABLE mailboxes (
@@ -15,44 +19,181 @@ CREATE TABLE mailboxes (
 	updated INTEGER,
 	for_nameplate BOOLEAN
 );
-CREATE INDEX idx_mailboxes ON mailboxes (app_id, id);
 
 CREATE TABLE mailbox_sides (
-	mailbox_id VARCHAR REFERENCES mailboxes(id),
+	mailbox_id VARCHAR NOT NULL REFERENCES mailboxes(id) ON DELETE CASCADE,
 	opened BOOLEAN,
 	side VARCHAR,
 	added INTEGER,
-	mood VARCHAR
+	mood VARCHAR,
+	UNIQUE (mailbox_id, side)
 );
-CREATE INDEX idx_mailbox_sides ON mailbox_sides (mailbox_id);
 
 CREATE TABLE messages (
 	id VARCHAR,
 	app_id VARCHAR,
-	mailbox_id VARCHAR REFERENCES mailboxes(id),
+	mailbox_id VARCHAR NOT NULL REFERENCES mailboxes(id) ON DELETE CASCADE,
 	side VARCHAR,
 	phase VARCHAR,
 	body VARCHAR,
-	server_rx INTEGER
+	server_rx INTEGER,
+	seq INTEGER
 );
-CREATE INDEX idx_messages ON messages (app_id, mailbox_id);
 
 CREATE TABLE nameplates (
 	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
 	app_id VARCHAR,
 	name VARCHAR,
-	mailbox_id VARCHAR REFERENCES mailboxes(id),
-	request_id VARCHAR DEFAULT ''
+	mailbox_id VARCHAR NOT NULL REFERENCES mailboxes(id) ON DELETE CASCADE,
+	request_id VARCHAR DEFAULT '',
+	UNIQUE (app_id, name)
 );
-CREATE INDEX idx_nameplates ON nameplates (app_id, name);
-CREATE INDEX idx_nameplates_mailbox ON nameplates (app_id, mailbox_id);
-CREATE INDEX idx_nameplates_request ON nameplates (app_id, request_id);
 
 CREATE TABLE nameplate_sides (
-	nameplate_id INTEGER REFERENCES nameplates(id) NOT NULL,
+	nameplate_id INTEGER NOT NULL REFERENCES nameplates(id) ON DELETE CASCADE,
 	claimed BOOLEAN,
 	side VARCHAR,
-	added INTEGER
+	added INTEGER,
+	UNIQUE (nameplate_id, side)
 );
-CREATE INDEX idx_nameplate_side ON nameplate_sides (nameplate_id, side);
 `
+
+//relayIndexes creates the indexes on the relay data tables,
+//the unique constraints already index their own columns
+const relayIndexes = `
+CREATE INDEX idx_mailboxes ON mailboxes (app_id, id);
+CREATE INDEX idx_messages ON messages (app_id, mailbox_id);
+CREATE UNIQUE INDEX idx_messages_seq ON messages (mailbox_id, seq);
+CREATE INDEX idx_nameplates_mailbox ON nameplates (mailbox_id);
+CREATE INDEX idx_nameplates_request ON nameplates (app_id, request_id);
+`
+
+//eventTables creates the table relays sharing the database
+//publish their mailbox events through
+const eventTables = `
+CREATE TABLE mailbox_events (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	node VARCHAR,
+	kind VARCHAR,
+	app_id VARCHAR,
+	mailbox_id VARCHAR,
+	seq INTEGER,
+	created INTEGER
+);
+CREATE INDEX idx_mailbox_events ON mailbox_events (created);
+`
+
+//migrations holds the statements that upgrade the schema
+//to the version they are keyed by, from the one before it.
+//Once released they must not change, so they are written out
+//in full rather than built from the current schema above
+var migrations = map[int]string{
+	//Messages are ordered by a per-mailbox sequence, existing
+	//messages take their insertion order
+	2: `
+ALTER TABLE messages ADD COLUMN seq INTEGER;
+UPDATE messages SET seq=rowid;
+CREATE INDEX idx_messages_seq ON messages (mailbox_id, seq);
+`,
+
+	//Tables are rebuilt with unique constraints and cascading
+	//deletes. Duplicate rows keep the first, and rows pointing at
+	//something that no longer exists are dropped
+	3: `
+ALTER TABLE nameplate_sides RENAME TO nameplate_sides_old;
+ALTER TABLE nameplates RENAME TO nameplates_old;
+ALTER TABLE messages RENAME TO messages_old;
+ALTER TABLE mailbox_sides RENAME TO mailbox_sides_old;
+ALTER TABLE mailboxes RENAME TO mailboxes_old;
+
+CREATE TABLE mailboxes (
+	id VARCHAR PRIMARY KEY,
+	app_id VARCHAR,
+	updated INTEGER,
+	for_nameplate BOOLEAN
+);
+
+CREATE TABLE mailbox_sides (
+	mailbox_id VARCHAR NOT NULL REFERENCES mailboxes(id) ON DELETE CASCADE,
+	opened BOOLEAN,
+	side VARCHAR,
+	added INTEGER,
+	mood VARCHAR,
+	UNIQUE (mailbox_id, side)
+);
+
+CREATE TABLE messages (
+	id VARCHAR,
+	app_id VARCHAR,
+	mailbox_id VARCHAR NOT NULL REFERENCES mailboxes(id) ON DELETE CASCADE,
+	side VARCHAR,
+	phase VARCHAR,
+	body VARCHAR,
+	server_rx INTEGER,
+	seq INTEGER
+);
+
+CREATE TABLE nameplates (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	app_id VARCHAR,
+	name VARCHAR,
+	mailbox_id VARCHAR NOT NULL REFERENCES mailboxes(id) ON DELETE CASCADE,
+	request_id VARCHAR DEFAULT '',
+	UNIQUE (app_id, name)
+);
+
+CREATE TABLE nameplate_sides (
+	nameplate_id INTEGER NOT NULL REFERENCES nameplates(id) ON DELETE CASCADE,
+	claimed BOOLEAN,
+	side VARCHAR,
+	added INTEGER,
+	UNIQUE (nameplate_id, side)
+);
+
+INSERT INTO mailboxes (id, app_id, updated, for_nameplate)
+	SELECT id, app_id, updated, for_nameplate FROM mailboxes_old;
+INSERT OR IGNORE INTO mailbox_sides (mailbox_id, opened, side, added, mood)
+	SELECT mailbox_id, opened, side, added, mood FROM mailbox_sides_old
+	WHERE mailbox_id IN (SELECT id FROM mailboxes) ORDER BY rowid;
+INSERT INTO messages (id, app_id, mailbox_id, side, phase, body, server_rx, seq)
+	SELECT id, app_id, mailbox_id, side, phase, body, server_rx, seq FROM messages_old
+	WHERE mailbox_id IN (SELECT id FROM mailboxes) ORDER BY rowid;
+INSERT OR IGNORE INTO nameplates (id, app_id, name, mailbox_id, request_id)
+	SELECT id, app_id, name, mailbox_id, request_id FROM nameplates_old
+	WHERE mailbox_id IN (SELECT id FROM mailboxes) ORDER BY id;
+INSERT OR IGNORE INTO nameplate_sides (nameplate_id, claimed, side, added)
+	SELECT nameplate_id, claimed, side, added FROM nameplate_sides_old
+	WHERE nameplate_id IN (SELECT id FROM nameplates) ORDER BY rowid;
+
+DROP TABLE nameplate_sides_old;
+DROP TABLE nameplates_old;
+DROP TABLE messages_old;
+DROP TABLE mailbox_sides_old;
+DROP TABLE mailboxes_old;
+
+CREATE INDEX idx_mailboxes ON mailboxes (app_id, id);
+CREATE INDEX idx_messages ON messages (app_id, mailbox_id);
+CREATE INDEX idx_messages_seq ON messages (mailbox_id, seq);
+CREATE INDEX idx_nameplates_mailbox ON nameplates (mailbox_id);
+CREATE INDEX idx_nameplates_request ON nameplates (app_id, request_id);
+`,
+
+	//Sequences are unique within a mailbox, so relays sharing the
+	//database can't hand out the same one, which they tell each other
+	//about through the events table
+	4: `
+DROP INDEX idx_messages_seq;
+CREATE UNIQUE INDEX idx_messages_seq ON messages (mailbox_id, seq);
+
+CREATE TABLE mailbox_events (
+	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+	node VARCHAR,
+	kind VARCHAR,
+	app_id VARCHAR,
+	mailbox_id VARCHAR,
+	seq INTEGER,
+	created INTEGER
+);
+CREATE INDEX idx_mailbox_events ON mailbox_events (created);
+`,
+}
@@ -0,0 +1,83 @@
+package db
+
+//postgresSchemaVersion is versioned apart from the SQLite schema,
+//as PostgreSQL started out with the constraints already in place
+const postgresSchemaVersion = 2
+
+const postgresSchema = `
+CREATE TABLE version (
+	version INTEGER NOT NULL
+);
+
+-- Relay data
+
+CREATE TABLE mailboxes (
+	id VARCHAR PRIMARY KEY,
+	app_id VARCHAR,
+	updated BIGINT,
+	for_nameplate BOOLEAN
+);
+
+CREATE TABLE mailbox_sides (
+	mailbox_id VARCHAR NOT NULL REFERENCES mailboxes(id) ON DELETE CASCADE,
+	opened BOOLEAN,
+	side VARCHAR,
+	added BIGINT,
+	mood VARCHAR,
+	UNIQUE (mailbox_id, side)
+);
+
+CREATE TABLE messages (
+	id VARCHAR,
+	app_id VARCHAR,
+	mailbox_id VARCHAR NOT NULL REFERENCES mailboxes(id) ON DELETE CASCADE,
+	side VARCHAR,
+	phase VARCHAR,
+	body TEXT,
+	server_rx DOUBLE PRECISION,
+	seq BIGINT
+);
+
+CREATE TABLE nameplates (
+	id BIGSERIAL PRIMARY KEY,
+	app_id VARCHAR,
+	name VARCHAR,
+	mailbox_id VARCHAR NOT NULL REFERENCES mailboxes(id) ON DELETE CASCADE,
+	request_id VARCHAR DEFAULT '',
+	UNIQUE (app_id, name)
+);
+
+CREATE TABLE nameplate_sides (
+	nameplate_id BIGINT NOT NULL REFERENCES nameplates(id) ON DELETE CASCADE,
+	claimed BOOLEAN,
+	side VARCHAR,
+	added BIGINT,
+	UNIQUE (nameplate_id, side)
+);
+` + relayIndexes + postgresEventTables
+
+//postgresEventTables creates the table relays sharing the database
+//publish their mailbox events through
+const postgresEventTables = `
+CREATE TABLE mailbox_events (
+	id BIGSERIAL PRIMARY KEY,
+	node VARCHAR,
+	kind VARCHAR,
+	app_id VARCHAR,
+	mailbox_id VARCHAR,
+	seq BIGINT,
+	created BIGINT
+);
+CREATE INDEX idx_mailbox_events ON mailbox_events (created);
+`
+
+//postgresMigrations holds the statements that upgrade the PostgreSQL
+//schema to the version they are keyed by, from the one before it
+var postgresMigrations = map[int]string{
+	//Sequences are unique within a mailbox, and relays publish
+	//their mailbox events through the events table
+	2: `
+DROP INDEX IF EXISTS idx_messages_seq;
+CREATE UNIQUE INDEX idx_messages_seq ON messages (mailbox_id, seq);
+` + postgresEventTables,
+}
@@ -0,0 +1,87 @@
+// +build cgo
+
+package db
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+
+	"github.com/chris-pikul/go-wormhole-server/config"
+	"github.com/chris-pikul/go-wormhole-server/log"
+)
+
+//driverName of the SQLite driver, when built with cgo
+//this is go-sqlite3 which wraps the C library
+const driverName = "sqlite3"
+
+//backupPages is how many pages are copied before letting
+//go of the database, so a running server can keep writing
+const backupPages = 256
+
+//dsn builds the connection string for the database file
+func dsn(filename string, opts config.DatabaseOptions, readOnly bool) string {
+	params := url.Values{}
+	if opts.BusyTimeout > 0 {
+		params.Set("_busy_timeout", strconv.Itoa(int(opts.BusyTimeout)))
+	}
+
+	if readOnly {
+		params.Set("mode", "ro")
+	} else {
+		if opts.JournalMode != "" {
+			params.Set("_journal_mode", strings.ToUpper(opts.JournalMode))
+		}
+
+		//Transactions take the write lock when they begin, instead of
+		//failing when upgrading to it part way through
+		params.Set("_txlock", "immediate")
+
+		//The schema relies on them for cascading deletes
+		params.Set("_foreign_keys", "1")
+	}
+
+	return "file:" + filename + "?" + params.Encode()
+}
+
+//backup copies the database file using the SQLite online backup
+//API. It copies a few pages at a time, so a running server is only
+//held up for a moment. Writes made during the backup are picked up
+//before it finishes
+func backup(filename, dest string) error {
+	drv := &sqlite3.SQLiteDriver{}
+	srcConn, err := drv.Open(dsn(filename, config.Opts.Relay.Database, true))
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	destConn, err := drv.Open(dest)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+
+	bk, err := destConn.(*sqlite3.SQLiteConn).Backup("main", srcConn.(*sqlite3.SQLiteConn), "main")
+	if err != nil {
+		return err
+	}
+
+	for {
+		done, err := bk.Step(backupPages)
+		if err != nil {
+			bk.Finish()
+			return err
+		} else if done {
+			break
+		}
+
+		log.Debugf("backed up %d of %d pages", bk.PageCount()-bk.Remaining(), bk.PageCount())
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	return bk.Finish()
+}
@@ -0,0 +1,64 @@
+// +build !cgo
+
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	//pure Go sqlite driver
+	_ "modernc.org/sqlite"
+
+	"github.com/chris-pikul/go-wormhole-server/config"
+)
+
+//driverName of the SQLite driver, when built without cgo
+//this is the pure Go translation of the C library
+const driverName = "sqlite"
+
+//dsn builds the connection string for the database file
+func dsn(filename string, opts config.DatabaseOptions, readOnly bool) string {
+	params := url.Values{}
+	if opts.BusyTimeout > 0 {
+		params.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", opts.BusyTimeout))
+	}
+
+	if readOnly {
+		params.Set("mode", "ro")
+	} else {
+		if opts.JournalMode != "" {
+			params.Add("_pragma", fmt.Sprintf("journal_mode(%s)", strings.ToUpper(opts.JournalMode)))
+		}
+
+		//Transactions take the write lock when they begin, instead of
+		//failing when upgrading to it part way through
+		params.Set("_txlock", "immediate")
+
+		//The schema relies on them for cascading deletes
+		params.Add("_pragma", "foreign_keys(1)")
+	}
+
+	return "file:" + filename + "?" + params.Encode()
+}
+
+//backup copies the database file with VACUUM INTO, as the pure Go
+//driver has no backup API. It reads the database in one transaction,
+//which in WAL mode does not hold up a running server
+func backup(filename, dest string) error {
+	//VACUUM INTO refuses to overwrite an existing database
+	if err := os.Remove(dest); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	src, err := sql.Open(driverName, dsn(filename, config.Opts.Relay.Database, true))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	_, err = src.Exec(`VACUUM INTO $1`, dest)
+	return err
+}
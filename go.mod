@@ -1,13 +1,31 @@
 module github.com/chris-pikul/go-wormhole-server
 
-go 1.12
+go 1.20
 
 require (
 	github.com/chris-pikul/go-wormhole v0.0.0
 	github.com/gorilla/websocket v1.4.0
-	github.com/mattn/go-sqlite3 v1.11.0
+	github.com/lib/pq v1.9.0
+	github.com/mattn/go-sqlite3 v1.14.22
 	github.com/sirupsen/logrus v1.4.2
 	github.com/urfave/cli v1.20.0
+	modernc.org/sqlite v1.29.5
+)
+
+require (
+	github.com/dustin/go-humanize v1.0.1 // indirect
+	github.com/google/uuid v1.3.0 // indirect
+	github.com/hashicorp/golang-lru/v2 v2.0.7 // indirect
+	github.com/mattn/go-isatty v0.0.16 // indirect
+	github.com/ncruces/go-strftime v0.1.9 // indirect
+	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
+	golang.org/x/sys v0.16.0 // indirect
+	modernc.org/gc/v3 v3.0.0-20240107210532-573471604cb6 // indirect
+	modernc.org/libc v1.41.0 // indirect
+	modernc.org/mathutil v1.6.0 // indirect
+	modernc.org/memory v1.7.2 // indirect
+	modernc.org/strutil v1.2.0 // indirect
+	modernc.org/token v1.1.0 // indirect
 )
 
 replace github.com/chris-pikul/go-wormhole v0.0.0 => E:/Go/src/github.com/chris-pikul/go-wormhole
@@ -1,8 +1,10 @@
 package log
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"reflect"
 )
 
 const (
@@ -16,15 +18,104 @@ const (
 	LevelError = "ERROR"
 )
 
+const (
+	//FormatText writes human readable lines, colored on terminals
+	FormatText = "text"
+	//FormatJSON writes each entry as a JSON object on its own line
+	FormatJSON = "json"
+	//FormatLogfmt writes each entry as key=value pairs on its own line
+	FormatLogfmt = "logfmt"
+)
+
+const (
+	//SinkStdout writes the logs to STDOUT
+	SinkStdout = "stdout"
+	//SinkStderr writes the logs to STDERR
+	SinkStderr = "stderr"
+	//SinkFile writes the logs to a file, which can be rotated
+	SinkFile = "file"
+	//SinkSyslog sends the logs to the syslog daemon over a local socket
+	SinkSyslog = "syslog"
+)
+
+//SinkOptions holds the settings for one of the places logs
+//are written to. Options that don't apply to the type are ignored
+type SinkOptions struct {
+	//Type of the sink. The values expected are:
+	//	stdout,stderr,file,syslog
+	Type string `json:"type"`
+
+	//Path holds the file path for file sinks, and the socket
+	//path for syslog sinks, where empty uses the system's socket
+	Path string `json:"path"`
+
+	//Format overrides the format of the logging options for
+	//this sink only
+	Format string `json:"format"`
+
+	//MaxSize is the size in megabytes a file grows to before it is
+	//rotated. 0 does not rotate on size
+	MaxSize uint `json:"maxSize"`
+
+	//MaxAge is the time in hours a file is written to before it is
+	//rotated. 0 does not rotate on age
+	MaxAge uint `json:"maxAge"`
+
+	//MaxBackups is how many rotated files are kept. 0 keeps them all
+	MaxBackups uint `json:"maxBackups"`
+
+	//Compress gzips the rotated files
+	Compress bool `json:"compress"`
+
+	//Tag is the program name syslog entries are sent under.
+	//If empty, "wormhole-server" is used
+	Tag string `json:"tag"`
+}
+
+//UsageOptions holds the settings for the usage log. Its entries
+//are always JSON, whatever the format of the sinks, as described
+//by UsageEvent
+type UsageOptions struct {
+	//Enabled writes the usage log
+	Enabled bool `json:"enabled"`
+
+	//Sinks lists the places the usage log is written to, such
+	//as a file with its own rotation. If empty, STDERR is used
+	Sinks []SinkOptions `json:"sinks"`
+}
+
+//UnmarshalJSON reads the usage options, or a boolean
+//enabling them as older configurations have
+func (o *UsageOptions) UnmarshalJSON(data []byte) error {
+	var enabled bool
+	if err := json.Unmarshal(data, &enabled); err == nil {
+		*o = UsageOptions{Enabled: enabled}
+		return nil
+	}
+
+	type usageOptions UsageOptions //Without this method
+	return json.Unmarshal(data, (*usageOptions)(o))
+}
+
 //Options holds the configuration settings
 //for the logging operations. This is JSON serializable
 //so we can load from a file.
 type Options struct {
 	//Path holds the file path to write logs too.
-	//If this value is empty, then no file writing is
-	//done and only STDOUT will be used
+	//It is a shorthand for a file sink without rotation
 	Path string `json:"path"`
 
+	//Format sets how the log entries are written.
+	//The values expected are:
+	//	text,json,logfmt
+	//Where the default is text
+	Format string `json:"format"`
+
+	//Sinks lists the places logs are written to, in addition
+	//to Path. If both are empty, STDERR is used,
+	//keeping STDOUT free for data such as db export
+	Sinks []SinkOptions `json:"sinks"`
+
 	//Level sets the logging level in which only
 	//messages at, or above, this level will be witten.
 	//The values expected are:
@@ -32,9 +123,9 @@ type Options struct {
 	//Where the default is INFO
 	Level string `json:"level"`
 
-	//Usage enables the logging of connection specific
-	//messages
-	Usage bool `json:"usage"`
+	//Usage holds the settings for the usage log, which records
+	//what clients do in its own stream, apart from these logs
+	Usage UsageOptions `json:"usage"`
 
 	//BlurTimes tells the logging facilities to
 	//round any access time logs to protect
@@ -42,7 +133,7 @@ type Options struct {
 	BlurTimes uint `json:"blurTimes"`
 
 	//ShowAddress enables the logging of connection
-	//addresses during usage messages
+	//addresses in the usage log, and client messages
 	ShowAddress bool `json:"showRemoteAddresses"`
 }
 
@@ -51,18 +142,30 @@ type Options struct {
 var DefaultOptions = Options{
 	Path:        "",
 	Level:       "DEBUG",
-	Usage:       true,
+	Format:      FormatText,
+	Usage:       UsageOptions{Enabled: true},
 	BlurTimes:   1,
 	ShowAddress: true,
 }
 
-//ErrOptionLevel specifies the level field of the LoggingOptions object is invalid
-var ErrOptionLevel = errors.New("invalid logging level option provided")
+var (
+	//ErrOptionLevel specifies the level field of the LoggingOptions object is invalid
+	ErrOptionLevel = errors.New("invalid logging level option provided")
+
+	//ErrOptionFormat specifies a format of the LoggingOptions object is invalid
+	ErrOptionFormat = errors.New("invalid logging format option provided, expected text, json or logfmt")
+
+	//ErrOptionSink specifies a sink of the LoggingOptions object is invalid
+	ErrOptionSink = errors.New("invalid logging sink option provided, expected stdout, stderr, syslog or a file with a path")
+)
 
 //Equals returns true if this object deep equals the provided one
 func (o Options) Equals(opt Options) bool {
 	return o.Path == opt.Path &&
 		o.Level == opt.Level &&
+		o.Format == opt.Format &&
+		reflect.DeepEqual(o.Sinks, opt.Sinks) &&
+		reflect.DeepEqual(o.Usage, opt.Usage) &&
 		o.BlurTimes == opt.BlurTimes
 }
 
@@ -78,15 +181,59 @@ func (o Options) Verify() error {
 		return ErrOptionLevel
 	}
 
+	if !validFormat(o.Format) {
+		return ErrOptionFormat
+	}
+
+	sinks := append(append([]SinkOptions{}, o.Sinks...), o.Usage.Sinks...)
+	for _, snk := range sinks {
+		switch snk.Type {
+		case SinkStdout, SinkStderr, SinkSyslog:
+		case SinkFile:
+			if snk.Path == "" {
+				return ErrOptionSink
+			}
+		default:
+			return ErrOptionSink
+		}
+
+		if !validFormat(snk.Format) {
+			return ErrOptionFormat
+		}
+	}
+
 	return nil
 }
 
+//validFormat returns true if the format is known, or empty
+func validFormat(format string) bool {
+	switch format {
+	case "", FormatText, FormatJSON, FormatLogfmt:
+		return true
+	}
+	return false
+}
+
+//sinks returns all the places logs are written to
+func (o Options) sinks() []SinkOptions {
+	sinks := append([]SinkOptions{}, o.Sinks...)
+	if o.Path != "" {
+		sinks = append(sinks, SinkOptions{Type: SinkFile, Path: o.Path})
+	}
+
+	if len(sinks) == 0 {
+		sinks = append(sinks, SinkOptions{Type: SinkStderr})
+	}
+	return sinks
+}
+
 //MergeFrom combines the values from the supplied LoggingOptions
 //parameter into this current options. Taking care to only override
 //things needed. Will verify the results and return the object
 //for any validation errors.
 //
-//Path will only be overriden if the supplied object has one
+//Path, Format, Sinks and BlurTimes will only be overriden if the
+//supplied object has them, Usage and ShowAddress always are
 func (o *Options) MergeFrom(opt Options) error {
 	if len(opt.Path) != 0 {
 		o.Path = opt.Path
@@ -96,7 +243,20 @@ func (o *Options) MergeFrom(opt Options) error {
 		o.Level = opt.Level
 	}
 
-	o.BlurTimes = opt.BlurTimes
+	if opt.Format != "" {
+		o.Format = opt.Format
+	}
+
+	if len(opt.Sinks) != 0 {
+		o.Sinks = opt.Sinks
+	}
+
+	if opt.BlurTimes != 0 {
+		o.BlurTimes = opt.BlurTimes
+	}
+
+	o.Usage = opt.Usage
+	o.ShowAddress = opt.ShowAddress
 
 	return o.Verify()
 }
@@ -65,22 +65,22 @@ func TestMerge(t *testing.T) {
 
 	err = tgt.MergeFrom(Options{
 		Path:      "some-path",
-		BlurTimes: true,
+		BlurTimes: 5,
 	})
 	if err != nil {
 		t.Error(err)
 	} else if tgt.Path != "some-path" {
 		t.Error("expected a different path")
-	} else if tgt.BlurTimes == false {
+	} else if tgt.BlurTimes != 5 {
 		t.Error("expected a different blur")
 	}
 
 	err = tgt.MergeFrom(Options{
-		BlurTimes: false,
+		BlurTimes: 0,
 	})
 	if err != nil {
 		t.Error(err)
-	} else if tgt.BlurTimes == false {
+	} else if tgt.BlurTimes != 5 {
 		t.Error("blur should have stuck")
 	}
 }
@@ -96,7 +96,7 @@ func TestCombine(t *testing.T) {
 	tgt := Options{
 		Level:     "DEBUG",
 		Path:      "some-path",
-		BlurTimes: true,
+		BlurTimes: 5,
 	}
 
 	opts, err = CombineOptions(tgt)
@@ -106,3 +106,34 @@ func TestCombine(t *testing.T) {
 
 	testOptions(opts, t)
 }
+
+func TestSinks(t *testing.T) {
+	opts := DefaultOptions
+	opts.Format = FormatJSON
+	opts.Sinks = []SinkOptions{
+		{Type: SinkStdout, Format: FormatLogfmt},
+		{Type: SinkFile, Path: "relay.log", MaxSize: 10, Compress: true},
+	}
+	testOptions(opts, t)
+
+	opts.Format = "xml"
+	if err := opts.Verify(); err != ErrOptionFormat {
+		t.Error("failed to catch bad format")
+	}
+
+	opts.Format = FormatText
+	opts.Sinks = []SinkOptions{{Type: SinkFile}}
+	if err := opts.Verify(); err != ErrOptionSink {
+		t.Error("failed to catch file sink without a path")
+	}
+
+	opts.Sinks = []SinkOptions{{Type: "kafka"}}
+	if err := opts.Verify(); err != ErrOptionSink {
+		t.Error("failed to catch bad sink type")
+	}
+
+	//STDOUT is left alone unless asked for, it may be data
+	if sinks := DefaultOptions.sinks(); len(sinks) != 1 || sinks[0].Type != SinkStderr {
+		t.Errorf("expected logs to default to stderr, found %v", sinks)
+	}
+}
@@ -1,8 +1,8 @@
 package log
 
 import (
-	"fmt"
-	"os"
+	"io/ioutil"
+	"sync"
 
 	"github.com/sirupsen/logrus"
 )
@@ -10,6 +10,11 @@ import (
 var logger = logrus.New()
 var logBlur = DefaultOptions.BlurTimes
 
+var (
+	sinks     []sink
+	lockSinks sync.Mutex
+)
+
 //Initialize sets up the logging interface for use without the server
 func Initialize(cfg Options) error {
 	//Double check the config is valid
@@ -31,16 +36,41 @@ func Initialize(cfg Options) error {
 		logger.Level = logrus.InfoLevel
 	}
 
-	//Use a file if we need too
-	if cfg.Path != "" {
-		//TODO: Support more logging targets like streams, urls, etc?
-		f, err := os.OpenFile(cfg.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0750)
+	//Open every sink before replacing the current ones,
+	//so a bad option leaves the logging as it was
+	opened := make([]sink, 0)
+	hooks := make(logrus.LevelHooks)
+	for _, opts := range cfg.sinks() {
+		snk, err := openSink(opts, cfg.Format)
 		if err != nil {
-			return fmt.Errorf("failed to open log file for writing\nerror: %s", err.Error())
+			for _, s := range opened {
+				s.Close()
+			}
+			return err
+		}
+
+		opened = append(opened, snk)
+		hooks.Add(snk)
+	}
+
+	lockSinks.Lock()
+	if err := initUsage(cfg); err != nil {
+		lockSinks.Unlock()
+		for _, s := range opened {
+			s.Close()
 		}
+		return err
+	}
 
-		logger.Out = f
+	logger.SetOutput(ioutil.Discard)
+	logger.SetFormatter(nopFormatter{})
+	logger.ReplaceHooks(hooks)
+
+	for _, s := range sinks {
+		s.Close()
 	}
+	sinks = opened
+	lockSinks.Unlock()
 
 	//Set the blur format
 	logBlur = cfg.BlurTimes
@@ -48,6 +78,39 @@ func Initialize(cfg Options) error {
 	return nil
 }
 
+//Reopen reopens the log files, and usage log files, after
+//external log rotation moved them away. Errors are logged
+//to the sinks still working
+func Reopen() {
+	lockSinks.Lock()
+	defer lockSinks.Unlock()
+
+	for _, s := range append(sinks, usageSinks...) {
+		if r, ok := s.(reopener); ok {
+			if err := r.Reopen(); err != nil {
+				Err("failed to reopen log file", err)
+			}
+		}
+	}
+}
+
+//Close closes all the sinks, including the usage log's, waiting
+//on any rotated files to finish compressing. Logs after are discarded
+func Close() {
+	lockSinks.Lock()
+	defer lockSinks.Unlock()
+
+	logger.ReplaceHooks(make(logrus.LevelHooks))
+	usageLogger.ReplaceHooks(make(logrus.LevelHooks))
+	usageEnabled = false
+
+	for _, s := range append(sinks, usageSinks...) {
+		s.Close()
+	}
+	sinks = nil
+	usageSinks = nil
+}
+
 //Get returns the underlying logrus logger object
 func Get() *logrus.Logger {
 	return logger
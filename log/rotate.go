@@ -0,0 +1,239 @@
+package log
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//backupTimeFormat names the rotated files, which sorts them by age
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+//ErrFileClosed is returned when writing to a log file after it was closed
+var ErrFileClosed = errors.New("log file is closed")
+
+//rotatingFile is a log file that moves itself aside once it grows
+//past a size, or has been written to for long enough, and starts
+//over. Rotated files are named after the time they were rotated,
+//such as relay.log.2006-01-02T15-04-05.000, and can be gzipped
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	compress   bool
+
+	file    *os.File
+	size    int64
+	opened  time.Time
+	rotated time.Time
+	lock    sync.Mutex
+
+	//Compressing and pruning the backups runs apart from writing
+	cleanLock sync.Mutex
+	cleaning  sync.WaitGroup
+}
+
+//openRotatingFile opens the log file of the sink for appending
+func openRotatingFile(opts SinkOptions) (*rotatingFile, error) {
+	f := &rotatingFile{
+		path:       opts.Path,
+		maxSize:    int64(opts.MaxSize) * 1024 * 1024,
+		maxAge:     time.Hour * time.Duration(opts.MaxAge),
+		maxBackups: int(opts.MaxBackups),
+		compress:   opts.Compress,
+	}
+
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open log file for writing\nerror: %s", err.Error())
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+	f.opened = time.Now()
+	return nil
+}
+
+//Write appends to the file, rotating it first if the
+//write would take it past its size, or it is too old
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.file == nil {
+		return 0, ErrFileClosed
+	}
+
+	if (f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize) ||
+		(f.maxAge > 0 && time.Since(f.opened) >= f.maxAge) {
+		if err := f.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to rotate log file %s: %s\n", f.path, err)
+			if f.file == nil {
+				return 0, err
+			}
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+//rotate moves the current file aside and opens a new one.
+//The backups are then compressed and pruned in the background
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+
+	//Backups are named to the millisecond, rotating twice
+	//within one takes the next, so none overwrite another
+	stamp := time.Now().Truncate(time.Millisecond)
+	if !stamp.After(f.rotated) {
+		stamp = f.rotated.Add(time.Millisecond)
+	}
+	f.rotated = stamp
+
+	//Whether moved aside or not, writing carries on
+	backup := f.path + "." + stamp.Format(backupTimeFormat)
+	renameErr := os.Rename(f.path, backup)
+	if err := f.open(); err != nil {
+		return err
+	} else if renameErr != nil {
+		return renameErr
+	}
+
+	f.cleaning.Add(1)
+	go f.cleanup(backup)
+	return nil
+}
+
+//cleanup compresses the backup if needed, and removes
+//the oldest backups past the most kept
+func (f *rotatingFile) cleanup(backup string) {
+	defer f.cleaning.Done()
+
+	f.cleanLock.Lock()
+	defer f.cleanLock.Unlock()
+
+	if f.compress {
+		if err := compressFile(backup); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to compress log file %s: %s\n", backup, err)
+		}
+	}
+
+	if f.maxBackups <= 0 {
+		return
+	}
+
+	backups, err := f.backups()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to list log file backups: %s\n", err)
+		return
+	}
+
+	for len(backups) > f.maxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to remove log file backup %s: %s\n", backups[0], err)
+		}
+		backups = backups[1:]
+	}
+}
+
+//backups returns the rotated files, oldest first
+func (f *rotatingFile) backups() ([]string, error) {
+	matches, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	backups := make([]string, 0, len(matches))
+	for _, m := range matches {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(m, f.path+"."), ".gz")
+		if _, err := time.Parse(backupTimeFormat, stamp); err == nil {
+			backups = append(backups, m)
+		}
+	}
+
+	sort.Strings(backups)
+	return backups, nil
+}
+
+//Reopen closes the file and opens the path again. Used after
+//external log rotation moved the file away
+func (f *rotatingFile) Reopen() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	return f.open()
+}
+
+//Close closes the file, writes after are refused.
+//Waits for the backups to finish compressing
+func (f *rotatingFile) Close() error {
+	f.lock.Lock()
+	var err error
+	if f.file != nil {
+		err = f.file.Close()
+		f.file = nil
+	}
+	f.lock.Unlock()
+
+	f.cleaning.Wait()
+	return err
+}
+
+//compressFile gzips the file next to it, and removes the original
+func compressFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(dst)
+	if _, err = io.Copy(zw, src); err == nil {
+		err = zw.Close()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+
+	src.Close()
+	return os.Remove(name)
+}
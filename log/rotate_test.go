@@ -0,0 +1,120 @@
+package log
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotateSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wormhole-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "relay.log")
+	f, err := openRotatingFile(SinkOptions{Path: path, MaxBackups: 2, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.maxSize = 100 //Megabytes are too much to wait for
+
+	line := strings.Repeat("x", 59) + "\n"
+	for i := 0; i < 8; i++ {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	//Every other line rotated, but only the newest backups are kept
+	backups, err := f.backups()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(backups) != 2 {
+		t.Fatalf("expected 2 backups, found %v", backups)
+	}
+
+	for _, b := range backups {
+		if !strings.HasSuffix(b, ".gz") {
+			t.Errorf("backup %s was not compressed", b)
+			continue
+		}
+
+		gz, err := os.Open(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr, err := gzip.NewReader(gz)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(zr)
+		gz.Close()
+		if err != nil {
+			t.Fatal(err)
+		} else if string(data) != line {
+			t.Errorf("backup %s held %q", b, data)
+		}
+	}
+
+	if data, err := ioutil.ReadFile(path); err != nil {
+		t.Fatal(err)
+	} else if string(data) != line {
+		t.Errorf("current log file held %q", data)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wormhole-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "relay.log")
+	opts := DefaultOptions
+	opts.Format = FormatJSON
+	opts.Sinks = []SinkOptions{{Type: SinkFile, Path: path}}
+	if err := Initialize(opts); err != nil {
+		t.Fatal(err)
+	}
+	defer Close()
+
+	Info("before")
+
+	//As logrotate would, then asking to reopen
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	Reopen()
+	Info("after")
+
+	for name, msg := range map[string]string{path + ".1": "before", path: "after"} {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		scanner := bufio.NewScanner(f)
+		if !scanner.Scan() {
+			t.Errorf("%s is empty", name)
+		} else {
+			entry := make(map[string]interface{})
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				t.Errorf("%s did not hold JSON: %s", name, err)
+			} else if entry["msg"] != msg || entry["level"] != "info" {
+				t.Errorf("%s held the entry %v, expected %s", name, entry, msg)
+			}
+		}
+		f.Close()
+	}
+}
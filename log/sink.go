@@ -0,0 +1,119 @@
+package log
+
+import (
+	"io"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+//sink is a place the log entries are written to. Each sink
+//is a hook on the logger, formatting the entries itself
+type sink interface {
+	logrus.Hook
+
+	//Close releases whatever the sink writes to
+	Close() error
+}
+
+//reopener is a sink writing to files that can be reopened,
+//after they were moved away by external log rotation
+type reopener interface {
+	Reopen() error
+}
+
+//writerSink writes the formatted entries to a writer
+type writerSink struct {
+	out       io.Writer
+	formatter logrus.Formatter
+}
+
+//Levels returns the levels the sink is fired for, which is all of
+//them as the logger already filters out those below its level
+func (s *writerSink) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+//Fire writes the entry
+func (s *writerSink) Fire(entry *logrus.Entry) error {
+	b, err := s.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.out.Write(b)
+	return err
+}
+
+//Close closes the writer, unless it is one of the standard streams
+func (s *writerSink) Close() error {
+	if c, ok := s.out.(io.Closer); ok && s.out != os.Stdout && s.out != os.Stderr {
+		return c.Close()
+	}
+	return nil
+}
+
+//Reopen reopens the file written to, if it is one
+func (s *writerSink) Reopen() error {
+	if f, ok := s.out.(*rotatingFile); ok {
+		return f.Reopen()
+	}
+	return nil
+}
+
+//openSink creates the sink for the options, using the
+//format if the sink has none of its own
+func openSink(opts SinkOptions, format string) (sink, error) {
+	if opts.Format != "" {
+		format = opts.Format
+	}
+
+	switch opts.Type {
+	case SinkStdout:
+		return &writerSink{out: os.Stdout, formatter: newFormatter(format, isTerminal(os.Stdout))}, nil
+	case SinkStderr:
+		return &writerSink{out: os.Stderr, formatter: newFormatter(format, isTerminal(os.Stderr))}, nil
+	case SinkFile:
+		f, err := openRotatingFile(opts)
+		if err != nil {
+			return nil, err
+		}
+		return &writerSink{out: f, formatter: newFormatter(format, false)}, nil
+	case SinkSyslog:
+		return openSyslog(opts, format)
+	}
+	return nil, ErrOptionSink
+}
+
+//newFormatter returns the logrus formatter for the format.
+//Text is colored when written to a terminal
+func newFormatter(format string, terminal bool) logrus.Formatter {
+	switch format {
+	case formatUsage:
+		return usageFormatter{}
+	case FormatJSON:
+		return &logrus.JSONFormatter{}
+	case FormatLogfmt:
+		return &logrus.TextFormatter{DisableColors: true, FullTimestamp: true}
+	}
+	return &logrus.TextFormatter{ForceColors: terminal, DisableColors: !terminal}
+}
+
+//isTerminal returns true if the file is a character device,
+//which is as close to a terminal as we need to know
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+//nopFormatter is the logger's own formatter, which writes
+//nothing as the sinks do the writing
+type nopFormatter struct{}
+
+//Format returns no bytes
+func (nopFormatter) Format(*logrus.Entry) ([]byte, error) {
+	return nil, nil
+}
@@ -0,0 +1,76 @@
+// +build !windows
+
+package log
+
+import (
+	"log/syslog"
+
+	"github.com/sirupsen/logrus"
+)
+
+//syslogSink sends the entries to the syslog daemon, with
+//the severity matching their level
+type syslogSink struct {
+	writer    *syslog.Writer
+	formatter logrus.Formatter
+}
+
+//openSyslog connects to the syslog daemon over the socket
+//at the path, or the system's own if empty
+func openSyslog(opts SinkOptions, format string) (sink, error) {
+	tag := opts.Tag
+	if tag == "" {
+		tag = "wormhole-server"
+	}
+
+	network := ""
+	if opts.Path != "" {
+		network = "unixgram"
+	}
+
+	w, err := syslog.Dial(network, opts.Path, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	//Syslog keeps its own time
+	var formatter logrus.Formatter = &logrus.TextFormatter{DisableColors: true, DisableTimestamp: true}
+	if format == FormatJSON {
+		formatter = &logrus.JSONFormatter{DisableTimestamp: true}
+	} else if format == formatUsage {
+		formatter = usageFormatter{}
+	}
+
+	return &syslogSink{writer: w, formatter: formatter}, nil
+}
+
+//Levels returns the levels the sink is fired for
+func (s *syslogSink) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+//Fire sends the entry at the severity of its level
+func (s *syslogSink) Fire(entry *logrus.Entry) error {
+	b, err := s.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	line := string(b)
+
+	switch entry.Level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return s.writer.Crit(line)
+	case logrus.ErrorLevel:
+		return s.writer.Err(line)
+	case logrus.WarnLevel:
+		return s.writer.Warning(line)
+	case logrus.InfoLevel:
+		return s.writer.Info(line)
+	}
+	return s.writer.Debug(line)
+}
+
+//Close disconnects from the syslog daemon
+func (s *syslogSink) Close() error {
+	return s.writer.Close()
+}
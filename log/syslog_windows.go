@@ -0,0 +1,15 @@
+// +build windows
+
+package log
+
+import (
+	"errors"
+)
+
+//ErrSyslogUnsupported is returned for syslog sinks on windows,
+//which has no syslog daemon to send to
+var ErrSyslogUnsupported = errors.New("syslog logging is not available on windows")
+
+func openSyslog(opts SinkOptions, format string) (sink, error) {
+	return nil, ErrSyslogUnsupported
+}
@@ -0,0 +1,154 @@
+package log
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	//UsageConnect is recorded when a client connects to the relay
+	UsageConnect = "connect"
+	//UsageBind is recorded when a client binds to an application
+	UsageBind = "bind"
+	//UsageAllocate is recorded when a client is allocated a nameplate
+	UsageAllocate = "allocate"
+	//UsageClaim is recorded when a client claims a nameplate
+	UsageClaim = "claim"
+	//UsageOpen is recorded when a client opens a mailbox
+	UsageOpen = "open"
+	//UsageClose is recorded when a client closes its mailbox, with
+	//its mood and how long the mailbox was open
+	UsageClose = "close"
+	//UsageDisconnect is recorded when a client disconnects, with
+	//how long it was connected
+	UsageDisconnect = "disconnect"
+)
+
+//UsageEvent is an entry of the usage log, written as a JSON
+//object on its own line. The fields, and their names, are kept
+//stable for tools reading the log:
+//
+//	{"time":"2006-01-02T15:04:05Z","event":"close","address":"192.0.2.1","app":"lothar.com/wormhole/text-or-file-xfer","mood":"happy","duration":12.5}
+//
+//Only time and event are always present
+type UsageEvent struct {
+	//Time the event happened in UTC, rounded down to the BlurTimes
+	Time time.Time `json:"time"`
+
+	//Event is one of the usage constants, such as UsageClaim
+	Event string `json:"event"`
+
+	//Address of the client, if ShowAddress is enabled
+	Address string `json:"address,omitempty"`
+
+	//AppID the client is bound to
+	AppID string `json:"app,omitempty"`
+
+	//Mood the client closed its mailbox with
+	Mood string `json:"mood,omitempty"`
+
+	//Duration in seconds the mailbox was open, or the client
+	//connected for
+	Duration float64 `json:"duration,omitempty"`
+}
+
+var usageLogger = logrus.New()
+
+var (
+	usageSinks   []sink
+	usageEnabled bool
+	usageAddress = DefaultOptions.ShowAddress
+)
+
+//initUsage opens the sinks of the usage log, replacing the
+//current ones. Called by Initialize with lockSinks held
+func initUsage(cfg Options) error {
+	opened := make([]sink, 0)
+	hooks := make(logrus.LevelHooks)
+	if cfg.Usage.Enabled {
+		sinks := cfg.Usage.Sinks
+		if len(sinks) == 0 {
+			sinks = []SinkOptions{{Type: SinkStderr}}
+		}
+
+		for _, opts := range sinks {
+			opts.Format = "" //Always JSON
+			snk, err := openSink(opts, formatUsage)
+			if err != nil {
+				for _, s := range opened {
+					s.Close()
+				}
+				return err
+			}
+
+			opened = append(opened, snk)
+			hooks.Add(snk)
+		}
+	}
+
+	usageLogger.SetOutput(ioutil.Discard)
+	usageLogger.SetFormatter(nopFormatter{})
+	usageLogger.ReplaceHooks(hooks)
+
+	for _, s := range usageSinks {
+		s.Close()
+	}
+	usageSinks = opened
+	usageEnabled = cfg.Usage.Enabled
+	usageAddress = cfg.ShowAddress
+	return nil
+}
+
+//Usage writes the event to the usage log, if enabled. The time
+//is set, and blurred, here. The address is dropped unless
+//ShowAddress is enabled
+func Usage(ev UsageEvent) {
+	if !usageEnabled {
+		return
+	}
+
+	ev.Time = time.Now().UTC()
+	if logBlur > 1 {
+		ev.Time = ev.Time.Truncate(time.Duration(logBlur) * time.Second)
+	}
+
+	if !usageAddress {
+		ev.Address = ""
+	}
+
+	usageLogger.WithField(usageField, ev).WithTime(ev.Time).Info()
+}
+
+//UsageEnabled returns true if the usage log is being written
+func UsageEnabled() bool {
+	return usageEnabled
+}
+
+const (
+	//formatUsage is the format of the usage log sinks
+	formatUsage = "usage"
+
+	//usageField holds the UsageEvent in the entries of the usage log
+	usageField = "usage"
+)
+
+//usageFormatter writes the usage events of the entries as JSON lines
+type usageFormatter struct{}
+
+//Format returns the event as JSON, or nothing if the
+//entry holds none
+func (usageFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	ev, ok := entry.Data[usageField].(UsageEvent)
+	if !ok {
+		return nil, nil
+	}
+
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
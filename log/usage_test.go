@@ -0,0 +1,88 @@
+package log
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUsageOptionsBool(t *testing.T) {
+	var opts Options
+	if err := json.Unmarshal([]byte(`{"usage": true}`), &opts); err != nil {
+		t.Fatal(err)
+	} else if !opts.Usage.Enabled {
+		t.Error("older boolean usage option was not read")
+	}
+
+	err := json.Unmarshal([]byte(`{"usage": {"enabled": true, "sinks": [{"type": "file", "path": "usage.log"}]}}`), &opts)
+	if err != nil {
+		t.Fatal(err)
+	} else if !opts.Usage.Enabled || len(opts.Usage.Sinks) != 1 || opts.Usage.Sinks[0].Path != "usage.log" {
+		t.Errorf("usage options were not read: %+v", opts.Usage)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wormhole-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "usage.log")
+	opts := DefaultOptions
+	opts.Sinks = []SinkOptions{{Type: SinkFile, Path: filepath.Join(dir, "server.log")}}
+	opts.Usage = UsageOptions{
+		Enabled: true,
+		Sinks:   []SinkOptions{{Type: SinkFile, Path: path, Format: FormatText}},
+	}
+	opts.BlurTimes = 60
+	opts.ShowAddress = false
+	if err := Initialize(opts); err != nil {
+		t.Fatal(err)
+	}
+	defer Close()
+
+	Info("not usage")
+	Usage(UsageEvent{Event: UsageClose, Address: "192.0.2.1", AppID: "app", Mood: "happy", Duration: 1.5})
+	Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	lines := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines++
+
+		entry := make(map[string]interface{})
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("usage log did not hold JSON: %s", err)
+		}
+
+		if _, ok := entry["address"]; ok {
+			t.Error("address was logged without ShowAddress")
+		}
+		if entry["event"] != UsageClose || entry["app"] != "app" || entry["mood"] != "happy" || entry["duration"] != 1.5 {
+			t.Errorf("unexpected usage entry %v", entry)
+		}
+
+		stamp, err := time.Parse(time.RFC3339, entry["time"].(string))
+		if err != nil {
+			t.Error(err)
+		} else if stamp.Second() != 0 || stamp.Nanosecond() != 0 {
+			t.Errorf("time %s was not blurred to the minute", stamp)
+		}
+	}
+
+	if lines != 1 {
+		t.Errorf("expected the usage event alone in the usage log, found %d lines", lines)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/rand"
 	"os"
@@ -10,6 +11,7 @@ import (
 	"time"
 
 	"github.com/chris-pikul/go-wormhole-server/config"
+	"github.com/chris-pikul/go-wormhole-server/db"
 	"github.com/chris-pikul/go-wormhole-server/log"
 	"github.com/chris-pikul/go-wormhole-server/relay"
 	"github.com/chris-pikul/go-wormhole-server/transit"
@@ -32,7 +34,8 @@ const usageText = `wormhole-server [global options...] [command]
 `
 
 var (
-	cfg config.Options
+	cfg     config.Options
+	cfgFile string
 
 	chanQuit = make(chan bool)
 )
@@ -86,6 +89,11 @@ func main() {
 			Usage: "`PORT` number to listen on",
 			Value: 4001,
 		},
+		cli.UintFlag{
+			Name:  "transit-ws-port",
+			Usage: "`PORT` number to accept transit websocket connections on (0 = disabled)",
+			Value: config.DefaultOptions.Transit.WebsocketPort,
+		},
 
 		cli.StringFlag{
 			Name:  "db, d",
@@ -115,7 +123,7 @@ func main() {
 
 		cli.StringFlag{
 			Name:  "log, l",
-			Usage: "`FILE` to write usage/error logs to (empty does not write logs)",
+			Usage: "`FILE` to write server logs to (empty does not write a file)",
 			Value: config.DefaultOptions.Logging.Path,
 		},
 		cli.StringFlag{
@@ -130,6 +138,29 @@ func main() {
 		},
 	}
 
+	//Flags for the database commands, which run without the servers
+	dbFlags := []cli.Flag{
+		cli.StringFlag{
+			Name:  "config, c",
+			Usage: "configuration JSON `FILE` to use instead of options (empty = no config)",
+		},
+		cli.StringFlag{
+			Name:  "db, d",
+			Usage: "path to SQLite database `FILE`",
+			Value: config.DefaultOptions.Relay.DBFile,
+		},
+		cli.StringFlag{
+			Name:  "log, l",
+			Usage: "`FILE` to write server logs to (empty does not write a file)",
+			Value: config.DefaultOptions.Logging.Path,
+		},
+		cli.StringFlag{
+			Name:  "log-level, L",
+			Usage: "logging `LEVEL` to use options are [DEBUG|INFO|WARN|ERROR]",
+			Value: config.DefaultOptions.Logging.Level,
+		},
+	}
+
 	app.Commands = []cli.Command{
 		cli.Command{
 			Name:   "serve",
@@ -154,7 +185,7 @@ func main() {
 				},
 				cli.StringFlag{
 					Name:  "log, l",
-					Usage: "`FILE` to write usage/error logs to (empty does not write logs)",
+					Usage: "`FILE` to write server logs to (empty does not write a file)",
 					Value: config.DefaultOptions.Logging.Path,
 				},
 				cli.StringFlag{
@@ -165,6 +196,41 @@ func main() {
 			},
 		},
 
+		cli.Command{
+			Name:  "db",
+			Usage: "backup, export or import the relay database",
+			Subcommands: []cli.Command{
+				cli.Command{
+					Name:      "backup",
+					Usage:     "copy the SQLite database to a file, safe to use while the server runs",
+					ArgsUsage: "FILE",
+					Action:    runDBBackup,
+					Flags:     dbFlags,
+				},
+				cli.Command{
+					Name:      "export",
+					Usage:     "dump the relay data as JSON to a file, or stdout",
+					ArgsUsage: "[FILE]",
+					Action:    runDBExport,
+					Flags:     dbFlags,
+				},
+				cli.Command{
+					Name:      "import",
+					Usage:     "load relay data exported as JSON from a file, or stdin",
+					ArgsUsage: "[FILE]",
+					Action:    runDBImport,
+					Flags:     dbFlags,
+				},
+				cli.Command{
+					Name:      "import-python",
+					Usage:     "load the state of a Python magic-wormhole-mailbox-server database",
+					ArgsUsage: "FILE",
+					Action:    runDBImportPython,
+					Flags:     dbFlags,
+				},
+			},
+		},
+
 		cli.Command{
 			Name:   "relay",
 			Usage:  "run as relay server (rendezvous) only",
@@ -214,7 +280,7 @@ func main() {
 
 				cli.StringFlag{
 					Name:  "log, l",
-					Usage: "`FILE` to write usage/error logs to (empty does not write logs)",
+					Usage: "`FILE` to write server logs to (empty does not write a file)",
 					Value: config.DefaultOptions.Logging.Path,
 				},
 				cli.StringFlag{
@@ -249,10 +315,15 @@ func main() {
 					Usage: "`PORT` number to listen on",
 					Value: 4001,
 				},
+				cli.UintFlag{
+					Name:  "transit-ws-port",
+					Usage: "`PORT` number to accept transit websocket connections on (0 = disabled)",
+					Value: config.DefaultOptions.Transit.WebsocketPort,
+				},
 
 				cli.StringFlag{
 					Name:  "log, l",
-					Usage: "`FILE` to write usage/error logs to (empty does not write logs)",
+					Usage: "`FILE` to write server logs to (empty does not write a file)",
 					Value: config.DefaultOptions.Logging.Path,
 				},
 				cli.StringFlag{
@@ -283,7 +354,7 @@ func initialize(c *cli.Context) error {
 	var err error
 
 	//Load the configuration (from file if needed)
-	cfgFile := c.String("config")
+	cfgFile = c.String("config")
 	cfg, err = config.NewOptions(nil, cfgFile, c)
 	if err != nil {
 		return fmt.Errorf("failed to parse configuration options; error = %s", err.Error())
@@ -306,19 +377,72 @@ func shutdown() {
 
 	relay.Shutdown(ctx)
 	transit.Shutdown(ctx)
+
+	//Last, so rotated log files finish compressing
+	log.Close()
 }
 
-//holds the main thread until either an interrupt from OS, or the chanQuit receives a message
+//re-reads the configuration file and applies the settings
+//that are allowed to change while the servers are running
+func reloadConfig() {
+	if cfgFile == "" {
+		log.Warn("received reload signal, but no configuration file is in use")
+		return
+	}
+
+	opts, err := config.ReadOptionsFromFile(cfgFile)
+	if err != nil {
+		log.Err("failed to reload configuration file '%s'", cfgFile, err)
+		return
+	}
+	log.Infof("reloaded configuration from '%s'", cfgFile)
+
+	relay.SetMaintenance(opts.Relay.Maintenance)
+
+	if err := relay.SetAccessLists(opts.Relay.AllowNetworks, opts.Relay.DenyNetworks); err != nil {
+		log.Err("failed to reload relay access lists", err)
+	}
+
+	if err := transit.SetAccessLists(opts.Transit.AllowNetworks, opts.Transit.DenyNetworks); err != nil {
+		log.Err("failed to reload transit access lists", err)
+	}
+}
+
+//holds the main thread until either an interrupt from OS, or the chanQuit receives a message.
+//Control signals (reload, maintenance, reopening logs) are handled while waiting
 func blockUntilSignalOrTermination() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
+	ctrlChan := make(chan os.Signal, 1)
+	signal.Notify(ctrlChan, sigReload)
+	if sigMaintenance != nil {
+		signal.Notify(ctrlChan, sigMaintenance)
+	}
+	if sigReopen != nil {
+		signal.Notify(ctrlChan, sigReopen)
+	}
+
 	//Block until terminated
-	select {
-	case <-sigChan:
-		log.Info("closing due to interrupt")
-	case <-chanQuit:
-		log.Info("closing from quit message")
+	for {
+		select {
+		case <-sigChan:
+			log.Info("closing due to interrupt")
+			return
+		case <-chanQuit:
+			log.Info("closing from quit message")
+			return
+		case sig := <-ctrlChan:
+			switch sig {
+			case sigReload:
+				reloadConfig()
+			case sigMaintenance:
+				relay.ToggleMaintenance()
+			case sigReopen:
+				log.Reopen()
+				log.Info("reopened log files")
+			}
+		}
 	}
 }
 
@@ -327,6 +451,12 @@ func runServer(c *cli.Context) error {
 		return err
 	}
 
+	if config.Opts.Transit.RequireRelay {
+		//Transit only serves clients the relay has seen
+		relay.TrackActivity(time.Minute * time.Duration(config.Opts.Transit.RelayWindow))
+		transit.SetHandshakeCheck(relay.AddressSeenRecently)
+	}
+
 	if err := beginRelay(); err != nil {
 		return err
 	}
@@ -354,6 +484,104 @@ func runClean(c *cli.Context) error {
 	return nil
 }
 
+func runDBBackup(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return errors.New("expected the FILE to backup the database to")
+	}
+
+	if err := initialize(c); err != nil {
+		return err
+	}
+
+	if err := db.Backup(c.Args().First()); err != nil {
+		log.Err("failed to backup database", err)
+		return err
+	}
+
+	return nil
+}
+
+func runDBExport(c *cli.Context) error {
+	if err := initialize(c); err != nil {
+		return err
+	}
+
+	if err := db.Initialize(); err != nil {
+		return err
+	}
+	defer db.Close()
+
+	out := os.Stdout
+	if name := c.Args().First(); name != "" && name != "-" {
+		file, err := os.Create(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	if err := db.ExportTo(out); err != nil {
+		log.Err("failed to export database", err)
+		return err
+	}
+
+	return nil
+}
+
+func runDBImport(c *cli.Context) error {
+	if err := initialize(c); err != nil {
+		return err
+	}
+
+	if err := db.Initialize(); err != nil {
+		return err
+	}
+	defer db.Close()
+
+	in := os.Stdin
+	if name := c.Args().First(); name != "" && name != "-" {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+
+	if err := db.ImportFrom(in); err != nil {
+		log.Err("failed to import database", err)
+		return err
+	}
+
+	return nil
+}
+
+func runDBImportPython(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return errors.New("expected the FILE of the Python server database")
+	}
+
+	if err := initialize(c); err != nil {
+		return err
+	}
+
+	if err := db.Initialize(); err != nil {
+		return err
+	}
+	defer db.Close()
+
+	report, err := db.ImportPython(c.Args().First())
+	if err != nil {
+		log.Err("failed to import Python server database", err)
+		return err
+	}
+
+	fmt.Printf("imported %d mailboxes, %d nameplates and %d messages, skipped %d rows\n",
+		report.Mailboxes, report.Nameplates, report.Messages, len(report.Skipped))
+	return nil
+}
+
 func runRelay(c *cli.Context) error {
 	if err := initialize(c); err != nil {
 		return err
@@ -374,6 +602,10 @@ func runTransit(c *cli.Context) error {
 		return err
 	}
 
+	if config.Opts.Transit.RequireRelay {
+		log.Warn("requireRelay has no effect without the relay running in the same process")
+	}
+
 	if err := beginTransit(); err != nil {
 		return err
 	}
@@ -390,8 +622,7 @@ func beginRelay() error {
 		log.Err("failed to start relay service", err)
 		return err
 	}
-	relay.Start()
-	return nil
+	return relay.Start()
 }
 
 func beginTransit() error {
@@ -0,0 +1,70 @@
+package relay
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/chris-pikul/go-wormhole-server/log"
+)
+
+var (
+	activityWindow time.Duration
+	activeAddrs    map[string]time.Time
+	lockActivity   sync.Mutex
+)
+
+//TrackActivity starts remembering the addresses of clients using
+//mailboxes, for at least the window, so that AddressSeenRecently
+//can answer for them. Tracking is off by default
+func TrackActivity(window time.Duration) {
+	lockActivity.Lock()
+	defer lockActivity.Unlock()
+
+	activityWindow = window
+	activeAddrs = make(map[string]time.Time)
+
+	log.Infof("tracking relay client activity for %s", window.String())
+}
+
+//AddressSeenRecently returns true if a client from the address has
+//used a mailbox on this relay within the tracking window. Clients
+//pick their transit side apart from their relay side, so the
+//address is the only thing both have in common. Every client
+//sharing the address, such as behind a NAT, is seen with it
+func AddressSeenRecently(addr net.IP) bool {
+	if addr == nil {
+		return false
+	}
+
+	lockActivity.Lock()
+	defer lockActivity.Unlock()
+
+	seen, ok := activeAddrs[addr.String()]
+	return ok && seen.After(time.Now().Add(-activityWindow))
+}
+
+//recordActivity remembers the client as having used a mailbox now
+func recordActivity(c *Client) {
+	lockActivity.Lock()
+	defer lockActivity.Unlock()
+
+	if activeAddrs == nil || c.remoteAddr == nil {
+		return //Not tracking
+	}
+
+	activeAddrs[c.remoteAddr.String()] = time.Now()
+}
+
+//pruneActivity forgets clients that are past the tracking window
+func pruneActivity() {
+	lockActivity.Lock()
+	defer lockActivity.Unlock()
+
+	since := time.Now().Add(-activityWindow)
+	for addr, seen := range activeAddrs {
+		if !seen.After(since) {
+			delete(activeAddrs, addr)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package relay
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAddressSeenRecently(t *testing.T) {
+	TrackActivity(time.Minute)
+	defer func() {
+		lockActivity.Lock()
+		activeAddrs = nil
+		lockActivity.Unlock()
+	}()
+
+	seen := net.ParseIP("192.0.2.1")
+	recordActivity(&Client{Side: "side1", remoteAddr: seen})
+
+	if !AddressSeenRecently(seen) {
+		t.Error("address using a mailbox was not seen")
+	}
+	if AddressSeenRecently(net.ParseIP("192.0.2.2")) {
+		t.Error("address that never used a mailbox was seen")
+	} else if AddressSeenRecently(nil) {
+		t.Error("missing address was seen")
+	}
+
+	//Once past the window it is forgotten
+	lockActivity.Lock()
+	activeAddrs[seen.String()] = time.Now().Add(-2 * time.Minute)
+	lockActivity.Unlock()
+	pruneActivity()
+	if AddressSeenRecently(seen) {
+		t.Error("address past the window was still seen")
+	}
+}
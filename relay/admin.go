@@ -0,0 +1,167 @@
+package relay
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/chris-pikul/go-wormhole-server/config"
+	"github.com/chris-pikul/go-wormhole-server/db"
+	"github.com/chris-pikul/go-wormhole-server/log"
+)
+
+var adminServer *http.Server
+
+//newAdminRouter returns the routes of the admin API
+func newAdminRouter() *http.ServeMux {
+	router := http.NewServeMux()
+	router.HandleFunc("/backup", adminOnly(http.MethodGet, handleAdminBackup))
+	router.HandleFunc("/export", adminOnly(http.MethodGet, handleAdminExport))
+	router.HandleFunc("/import", adminOnly(http.MethodPost, handleAdminImport))
+	return router
+}
+
+//startAdmin spins up the admin API as a coroutine, if it is configured
+func startAdmin() error {
+	opts := config.Opts.Relay.Admin
+	if opts.Port == 0 {
+		return nil
+	}
+
+	adminServer = &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", opts.Host, opts.Port),
+		Handler: newAdminRouter(),
+	}
+
+	listener, err := net.Listen("tcp", adminServer.Addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		log.Infof("starting admin API on %s", adminServer.Addr)
+		err := adminServer.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Err("closing admin API encountered an error", err)
+		}
+		log.Info("admin API closed")
+	}()
+
+	return nil
+}
+
+//shutdownAdmin gracefully stops the admin API if it is running
+func shutdownAdmin(ctx context.Context) error {
+	if adminServer == nil {
+		return nil
+	}
+
+	err := adminServer.Shutdown(ctx)
+	log.Info("shutdown admin API")
+	return err
+}
+
+//adminOnly wraps the handler so it only serves requests using the
+//method, that present the admin token as their bearer token
+func adminOnly(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := config.Opts.Relay.Admin.Token
+		if token == "" || subtle.ConstantTimeCompare([]byte(bearerToken(r)), []byte(token)) != 1 {
+			log.Warnf("refusing admin request for %s without a valid token", r.URL.Path)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+//handleAdminBackup sends an online backup of the SQLite database.
+//The backup is written to a temporary file first, so the database
+//is not held up by a slow download
+func handleAdminBackup(w http.ResponseWriter, r *http.Request) {
+	tmp, err := ioutil.TempFile("", "wormhole-backup-*.db")
+	if err != nil {
+		log.Err("failed to create temporary file for backup", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	filename := tmp.Name()
+	tmp.Close()
+	defer os.Remove(filename)
+
+	if err := db.Backup(filename); err == db.ErrBackupPostgres {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	} else if err != nil {
+		log.Err("failed to backup database", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		log.Err("failed to open database backup", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", "application/vnd.sqlite3")
+	w.Header().Set("Content-Disposition", `attachment; filename="wormhole-relay.db"`)
+	if _, err := io.Copy(w, file); err != nil {
+		log.Err("failed to send database backup", err)
+	}
+}
+
+//handleAdminExport sends the relay data as JSON
+func handleAdminExport(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := db.ExportTo(w); err != nil {
+		log.Err("failed to export database", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+//handleAdminImport loads the relay data sent as JSON, nothing
+//is loaded if the dump is refused
+func handleAdminImport(w http.ResponseWriter, r *http.Request) {
+	dump := db.Dump{}
+	if err := json.NewDecoder(r.Body).Decode(&dump); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	//The sides that had the mailboxes open are still connected to the
+	//old host, and open them again once they reconnect here. So they are
+	//closed and the mailboxes touched, as reconcile does on startup
+	now := time.Now().Unix()
+	for i := range dump.Mailboxes {
+		dump.Mailboxes[i].Updated = now
+		for j := range dump.Mailboxes[i].Sides {
+			dump.Mailboxes[i].Sides[j].Opened = false
+		}
+	}
+
+	if err := db.Import(&dump); err != nil {
+		log.Err("failed to import database", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,139 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/chris-pikul/go-wormhole-server/config"
+	"github.com/chris-pikul/go-wormhole-server/db"
+	"github.com/chris-pikul/go-wormhole/msg"
+)
+
+const testAdminToken = "admin-secret"
+
+//adminRequest serves the request through the admin API
+func adminRequest(method, path, token string, body io.Reader) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, body)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rec := httptest.NewRecorder()
+	newAdminRouter().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminAuth(t *testing.T) {
+	defer setupRelay(t)()
+
+	//Without a configured token nobody gets in
+	if rec := adminRequest(http.MethodGet, "/export", "", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected unconfigured admin API to refuse, got %d", rec.Code)
+	}
+
+	config.Opts.Relay.Admin.Token = testAdminToken
+	if rec := adminRequest(http.MethodGet, "/export", "", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected missing token to be refused, got %d", rec.Code)
+	}
+	if rec := adminRequest(http.MethodGet, "/export", "wrong", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected wrong token to be refused, got %d", rec.Code)
+	}
+	if rec := adminRequest(http.MethodPost, "/export", testAdminToken, nil); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected wrong method to be refused, got %d", rec.Code)
+	}
+	if rec := adminRequest(http.MethodGet, "/export", testAdminToken, nil); rec.Code != http.StatusOK {
+		t.Errorf("expected valid token to be served, got %d", rec.Code)
+	}
+}
+
+func TestAdminExportImport(t *testing.T) {
+	teardown := setupRelay(t)
+	config.Opts.Relay.Admin.Token = testAdminToken
+
+	c := newTestClient(t, "side1")
+	if err := c.HandleClaim(msg.Claim{Nameplate: "4"}); err != nil {
+		teardown()
+		t.Fatal(err)
+	}
+	mbid := claimed(c)
+	if err := c.HandleOpen(msg.Open{Mailbox: mbid}); err != nil {
+		teardown()
+		t.Fatal(err)
+	}
+
+	rec := adminRequest(http.MethodGet, "/export", testAdminToken, nil)
+	teardown()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("export failed with %d: %s", rec.Code, rec.Body.String())
+	}
+	exported := rec.Body.Bytes()
+
+	//Load it into a fresh relay, as when moving to a new host
+	defer setupRelay(t)()
+	config.Opts.Relay.Admin.Token = testAdminToken
+
+	rec = adminRequest(http.MethodPost, "/import", testAdminToken, bytes.NewReader(exported))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("import failed with %d: %s", rec.Code, rec.Body.String())
+	}
+
+	dump, err := db.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dump.Nameplates) != 1 || dump.Nameplates[0].Name != "4" || dump.Nameplates[0].MailboxID != mbid {
+		t.Errorf("imported nameplates do not match the export: %+v", dump.Nameplates)
+	}
+
+	//The side that had it open is on the old host until it reconnects
+	if len(dump.Mailboxes) != 1 || len(dump.Mailboxes[0].Sides) != 1 || dump.Mailboxes[0].Sides[0].Opened {
+		t.Errorf("imported mailbox sides should be closed: %+v", dump.Mailboxes)
+	}
+
+	//The same data again conflicts, and is refused as a whole
+	rec = adminRequest(http.MethodPost, "/import", testAdminToken, bytes.NewReader(exported))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected conflicting import to be refused, got %d", rec.Code)
+	}
+
+	rec = adminRequest(http.MethodPost, "/import", testAdminToken, bytes.NewReader([]byte("not json")))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected bad import to be refused, got %d", rec.Code)
+	}
+
+	var again db.Dump
+	rec = adminRequest(http.MethodGet, "/export", testAdminToken, nil)
+	if err := json.Unmarshal(rec.Body.Bytes(), &again); err != nil {
+		t.Fatal(err)
+	} else if len(again.Mailboxes) != len(dump.Mailboxes) {
+		t.Error("refused imports should not have loaded anything")
+	}
+}
+
+func TestAdminBackup(t *testing.T) {
+	defer setupRelay(t)()
+	config.Opts.Relay.Admin.Token = testAdminToken
+
+	c := newTestClient(t, "side1")
+	if err := c.HandleClaim(msg.Claim{Nameplate: "4"}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := adminRequest(http.MethodGet, "/backup", testAdminToken, nil)
+	if postgresDSN != "" {
+		if rec.Code != http.StatusNotImplemented {
+			t.Errorf("expected PostgreSQL backup to be refused, got %d", rec.Code)
+		}
+		return
+	}
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("backup failed with %d: %s", rec.Code, rec.Body.String())
+	} else if !bytes.HasPrefix(rec.Body.Bytes(), []byte("SQLite format 3\x00")) {
+		t.Error("backup is not an SQLite database")
+	}
+}
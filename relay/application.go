@@ -1,6 +1,7 @@
 package relay
 
 import (
+	"context"
 	crand "crypto/rand"
 	"database/sql"
 	"encoding/base32"
@@ -9,13 +10,19 @@ import (
 	"math/rand"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/chris-pikul/go-wormhole-server/config"
 	"github.com/chris-pikul/go-wormhole-server/db"
 	"github.com/chris-pikul/go-wormhole-server/log"
 	"github.com/chris-pikul/go-wormhole/errs"
 )
 
+//MoodPruney is the mood recorded for sides of a mailbox
+//that was removed by cleaning instead of being closed
+const MoodPruney = "pruney"
+
 //Application holds the data for interacting with
 //an individual applications usage with the relay server.
 //All mailboxes are broken down into their parent apps
@@ -26,6 +33,11 @@ type Application struct {
 	ID string
 
 	Mailboxes map[string]*Mailbox
+
+	//publish sends mailbox events to the other relays
+	publish func(MailboxEvent)
+
+	lock *sync.Mutex //Guards Mailboxes, shared by the copies
 }
 
 type nameplate struct {
@@ -49,20 +61,40 @@ func NewApplication(id string) (Application, error) {
 	app := Application{
 		ID:        id,
 		Mailboxes: make(map[string]*Mailbox),
+		lock:      &sync.Mutex{},
 	}
 
 	return app, nil
 }
 
+//Policy returns the configured policy for this application
+func (a Application) Policy() config.AppPolicy {
+	if config.Opts == nil {
+		return config.DefaultOptions.Relay.Policy(a.ID)
+	}
+	return config.Opts.Relay.Policy(a.ID)
+}
+
 //Free is called when the service is closing and the final
 //death-throws should be performed
 func (a *Application) Free() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
 	for _, mbox := range a.Mailboxes {
 		mbox.RemoveAllListeners()
 	}
 	a.Mailboxes = make(map[string]*Mailbox)
 }
 
+//mailbox returns the mailbox if it is in memory, or nil
+func (a Application) mailbox(id string) *Mailbox {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.Mailboxes[id]
+}
+
 //GetNameplateIDs returns all the nameplate IDs used
 //by the current application. This should only be allowed
 //if the config option AllowList is true.
@@ -73,7 +105,7 @@ func (a Application) GetNameplateIDs() ([]string, error) {
 		return res, db.ErrNotOpen
 	}
 
-	rows, err := db.Get().Query(`SELECT DISTINCT name FROM nameplates WHERE app_id=$1`, a.ID)
+	rows, err := db.Reader().Query(`SELECT DISTINCT name FROM nameplates WHERE app_id=$1`, a.ID)
 	if err != nil {
 		log.Err("failed to get nameplate IDs from DB", err)
 		return res, err
@@ -96,6 +128,23 @@ func (a Application) GetNameplateIDs() ([]string, error) {
 	return res, nil
 }
 
+//HasNameplate returns true if the nameplate name is already
+//registered in the database for this application
+func (a Application) HasNameplate(name string) (bool, error) {
+	if db.Get() == nil {
+		return false, db.ErrNotOpen
+	}
+
+	var exists bool
+	row := db.Reader().QueryRow(`SELECT COUNT(*)>0 FROM nameplates WHERE app_id=$1 AND name=$2`, a.ID, name)
+	if err := row.Scan(&exists); err != nil && err != sql.ErrNoRows {
+		log.Err("checking nameplate existance for HasNameplate", err)
+		return false, err
+	}
+
+	return exists, nil
+}
+
 //FindNameplate attempts to find an available nameplate
 //to return back for clients to use
 func (a Application) FindNameplate() (string, error) {
@@ -105,6 +154,10 @@ func (a Application) FindNameplate() (string, error) {
 		return "", err
 	}
 
+	if a.Policy().NameplateStrategy == config.NameplatesSequential {
+		return lowestNameplate(claimed), nil
+	}
+
 	//Attempt to generate a pseudo random nameplate ID
 	for i := 1; i < 4; i++ {
 		avail := make([]string, 0)
@@ -152,88 +205,196 @@ func (a Application) FindNameplate() (string, error) {
 	return "", errors.New("no available nameplate IDs")
 }
 
-//ClaimNameplate claims a nameplate and it's respective mailbox.
+//lowestNameplate returns the lowest numbered nameplate
+//that is not in the claimed list
+func lowestNameplate(claimed []string) string {
+	taken := make(map[string]bool, len(claimed))
+	for _, c := range claimed {
+		taken[c] = true
+	}
+
+	i := 1
+	for taken[strconv.Itoa(i)] {
+		i++
+	}
+	return strconv.Itoa(i)
+}
+
+//ClaimNameplate claims a nameplate for the side, and opens it's
+//respective mailbox. Claiming again from the same side is allowed,
+//but not after that side released it. A third side can not claim it.
 //Returns the mailbox ID, or an error if one occured
 func (a Application) ClaimNameplate(name, side string) (string, error) {
 	if db.Get() == nil {
 		return "", db.ErrNotOpen
 	}
 
-	var mbid string
-	var npid int
+	stmt, err := db.Stmt(`SELECT * FROM nameplates WHERE app_id=$1 AND name=$2`)
+	if err != nil {
+		return "", err
+	}
+
 	np := nameplate{}
-	row := db.Get().QueryRow(`SELECT * FROM nameplates WHERE app_id=$1 AND name=$2`, a.ID, name)
-	if err := row.Scan(&np.id, &np.appID, &np.name, &np.mailboxID, &np.requestID); err != nil {
-		if err == sql.ErrNoRows {
-			log.Infof("creating nameplate %s for application %s", name, a.ID)
+	row := stmt.QueryRow(a.ID, name)
+	err = row.Scan(&np.id, &np.appID, &np.name, &np.mailboxID, &np.requestID)
+	if err == sql.ErrNoRows {
+		if np, err = a.createNameplate(name, side); err != nil {
+			return "", err
+		}
+	} else if err != nil {
+		log.Err("failed to find existing nameplates for ClaimNameplate", err)
+		return "", err
+	}
+	npid := np.id
+	mbid := np.mailboxID
 
-			mbid = generateMailboxID()
-			err = a.AddMailbox(mbid, true, side)
-			if err != nil {
-				log.Err("could not add mailbox for ClaimNameplate", err)
-				return "", err
-			}
+	if err = claimSide(npid, side); err != nil {
+		return "", err
+	}
 
-			npres, e := db.Get().Exec(`INSERT INTO nameplates (app_id, name, mailbox_id) 
-				VALUES ($1, $2, $3)`, a.ID, name, mbid)
-			if e != nil {
-				log.Err("could not create nameplate for ClaimNameplate", err)
-				return "", e
-			}
-			npidl, e := npres.LastInsertId()
-			if e != nil {
-				log.Err("failed to get new nameplate id for ClaimNameplate", err)
-				return "", e
-			}
-			npid = int(npidl)
-		} else {
-			log.Err("failed to find existing nameplates for ClaimNameplate", err)
-			return "", err
+	_, err = a.OpenMailbox(mbid, side)
+	if err != nil {
+		log.Err("could not open mailbox for ClaimNameplate", err)
+		return "", err
+	}
+
+	return mbid, nil
+}
+
+//createNameplate adds the nameplate along with a new mailbox for it.
+//If a concurrent claim created it first, the unique constraint keeps
+//theirs, which is returned instead
+func (a Application) createNameplate(name, side string) (nameplate, error) {
+	np := nameplate{}
+	log.Infof("creating nameplate %s for application %s", name, a.ID)
+
+	mbid := generateMailboxID()
+	if err := a.AddMailbox(mbid, true, side); err != nil {
+		log.Err("could not add mailbox for ClaimNameplate", err)
+		return np, err
+	}
+
+	res, err := db.Get().Exec(`INSERT INTO nameplates (app_id, name, mailbox_id)
+		VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`, a.ID, name, mbid)
+	if err != nil {
+		log.Err("could not create nameplate for ClaimNameplate", err)
+		return np, err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return np, err
+	} else if n == 0 {
+		log.Debugf("nameplate %s was created by another claim", name)
+		if _, err := db.Get().Exec(`DELETE FROM mailboxes WHERE id=$1`, mbid); err != nil {
+			return np, err
 		}
-	} else {
-		npid = np.id
-		mbid = np.mailboxID
+	}
+
+	row := db.Get().QueryRow(`SELECT * FROM nameplates WHERE app_id=$1 AND name=$2`, a.ID, name)
+	err = row.Scan(&np.id, &np.appID, &np.name, &np.mailboxID, &np.requestID)
+	return np, err
+}
+
+//claimSide adds the side to the nameplate, unless it would be a third
+//side, in one transaction. The nameplate's row is written first, which
+//on PostgreSQL locks it until the transaction ends, and on SQLite the
+//transaction already holds the write lock, so claims on the same
+//nameplate take turns
+func claimSide(npid int, side string) error {
+	//Prepared before the transaction takes the writer connection
+	lockStmt, err := db.Stmt(`UPDATE nameplates SET request_id=request_id WHERE id=$1`)
+	if err != nil {
+		return err
+	}
+	sideStmt, err := db.Stmt(`SELECT * FROM nameplate_sides WHERE nameplate_id=$1 AND side=$2`)
+	if err != nil {
+		return err
+	}
+	sidesStmt, err := db.Stmt(`SELECT DISTINCT side FROM nameplate_sides WHERE nameplate_id=$1`)
+	if err != nil {
+		return err
+	}
+	insertStmt, err := db.Stmt(`INSERT INTO nameplate_sides (nameplate_id, claimed, side, added)
+		VALUES ($1, true, $2, $3)`)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Get().Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.Stmt(lockStmt).Exec(npid); err != nil {
+		tx.Rollback()
+		log.Err("locking nameplate for ClaimNameplate", err)
+		return err
 	}
 
 	nps := nameplateSide{}
-	row = db.Get().QueryRow(`SELECT * FROM nameplate_sides WHERE nameplate_id=$1 AND side=$2`, npid, side)
-	if err := row.Scan(&nps.nameplateID, &nps.claimed, &nps.side, &nps.added); err != nil {
-		if err == sql.ErrNoRows {
-			_, err = db.Get().Exec(`INSERT INTO nameplate_sides (nameplate_id, claimed, side, added)
-				VALUES ($1, true, $2, $3)`, npid, side, time.Now().Unix())
-			if err != nil {
-				log.Err("inserting new nameplate side for ClaimNameplate", err)
-				return "", err
-			}
-		} else {
-			log.Err("selecting existing nameplate sides for ClaimNameplate", err)
-			return "", err
+	row := tx.Stmt(sideStmt).QueryRow(npid, side)
+	if err := row.Scan(&nps.nameplateID, &nps.claimed, &nps.side, &nps.added); err == nil {
+		tx.Rollback()
+		if !nps.claimed {
+			return errs.ErrReclaimNameplate //Cannot reclaim after releasing
 		}
+		return nil
+	} else if err != sql.ErrNoRows {
+		tx.Rollback()
+		log.Err("selecting existing nameplate sides for ClaimNameplate", err)
+		return err
 	}
 
-	if nps.claimed {
-		return "", errs.ErrReclaimNameplate //Cannot reclaim from the same side
+	//New side, which can only join if there is room
+	crowded, err := crowdedBy(side, tx.Stmt(sidesStmt), npid)
+	if err != nil {
+		tx.Rollback()
+		log.Err("counting nameplate sides for ClaimNameplate", err)
+		return err
+	} else if crowded {
+		tx.Rollback()
+		log.Warnf("nameplate %d is crowded", npid)
+		return errs.ErrNameplateCrowded
 	}
 
-	_, err := a.OpenMailbox(mbid, side)
-	if err != nil {
-		log.Err("could not open mailbox for ClaimNameplate", err)
-		return "", err
+	if _, err = tx.Stmt(insertStmt).Exec(npid, side, time.Now().Unix()); err != nil {
+		tx.Rollback()
+		log.Err("inserting new nameplate side for ClaimNameplate", err)
+		return err
 	}
 
-	var sidesOpen int
-	row = db.Get().QueryRow(`SELECT COUNT(*) FROM nameplate_sides WHERE nameplate_id=$1`, npid)
-	if err := row.Scan(&sidesOpen); err != nil && err != sql.ErrNoRows {
-		log.Err("counting open nameplate_sides for ClaimNameplate", err)
-		return "", err
+	if err = tx.Commit(); err != nil {
+		log.Err("committing nameplate side for ClaimNameplate", err)
 	}
+	return err
+}
 
-	if sidesOpen > 2 {
-		log.Warnf("nameplate %s is crowded", npid)
-		return "", errs.ErrNameplateCrowded
+//crowdedBy returns true if the side would be a third distinct
+//side among the sides returned by the statement
+func crowdedBy(side string, stmt *sql.Stmt, args ...interface{}) (bool, error) {
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return false, err
 	}
+	defer rows.Close()
 
-	return mbid, nil
+	others := 0
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return false, err
+		}
+
+		if s == side {
+			return false, nil //Already one of them
+		}
+		others++
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	return others >= 2, nil
 }
 
 //AllocateNameplate generates a new nameplate ID and associates
@@ -302,13 +463,7 @@ func (a Application) ReleaseNameplate(name, side string) error {
 		return nil //Still active claims
 	}
 
-	//Delete the nameplate and free it
-	_, err = db.Get().Exec(`DELETE FROM nameplate_sides WHERE nameplate_id=$1`, np.id)
-	if err != nil {
-		log.Err("deleting nameplate sides for ReleaseNameplate", err)
-		return err
-	}
-
+	//Delete the nameplate and free it, its sides go with it
 	_, err = db.Get().Exec(`DELETE FROM nameplates WHERE id=$1`, np.id)
 	if err != nil {
 		log.Err("deleting nameplate for ReleaseNameplate", err)
@@ -322,19 +477,9 @@ func (a Application) AddMailbox(id string, forNameplate bool, side string) error
 		return db.ErrNotOpen
 	}
 
-	var exists bool
-	row := db.Get().QueryRow(`SELECT COUNT(*)>0 FROM mailboxes WHERE app_id=$1 AND id=$2`, a.ID, id)
-	if err := row.Scan(&exists); err != nil && err != sql.ErrNoRows {
-		log.Err("getting mailboxes for AddMailbox", err)
-		return err
-	}
-
-	if exists {
-		return nil
-	}
-
+	//Adding an existing mailbox is a no-op
 	_, err := db.Get().Exec(`INSERT INTO mailboxes (app_id, id, for_nameplate, updated)
-		VALUES ($1, $2, $3, $4)`, a.ID, id, forNameplate, time.Now().Unix())
+		VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING`, a.ID, id, forNameplate, time.Now().Unix())
 	if err != nil {
 		log.Err("inserting new mailbox for AddMailbox", err)
 	}
@@ -354,11 +499,29 @@ func (a Application) OpenMailbox(id, side string) (*Mailbox, error) {
 		return nil, err
 	}
 
+	//A new side can only join if there is room
+	stmt, err := db.Stmt(`SELECT DISTINCT side FROM mailbox_sides WHERE mailbox_id=$1`)
+	if err != nil {
+		return nil, err
+	}
+
+	crowded, err := crowdedBy(side, stmt, id)
+	if err != nil {
+		log.Err("counting mailbox sides for OpenMailbox", err)
+		return nil, err
+	} else if crowded {
+		log.Warnf("mailbox %s is crowded", id)
+		return nil, errs.ErrMailboxCrowded
+	}
+
+	a.lock.Lock()
 	mbox, has := a.Mailboxes[id]
 	if !has {
 		mbox = NewMailbox(id, a.ID)
+		mbox.publish = a.publish
 		a.Mailboxes[id] = mbox
 	}
+	a.lock.Unlock()
 
 	err = mbox.Open(side)
 	if err != nil {
@@ -366,142 +529,175 @@ func (a Application) OpenMailbox(id, side string) (*Mailbox, error) {
 		return nil, err
 	}
 
-	var sidesOpen int
-	row := db.Get().QueryRow(`SELECT COUNT(*) FROM mailbox_sides WHERE mailbox_id=$1`, id)
-	if err := row.Scan(&sidesOpen); err != nil && err != sql.ErrNoRows {
-		log.Err("counting mailbox sides for OpenMailbox", err)
-		return nil, err
-	}
-
-	if sidesOpen > 2 {
-		return nil, errs.ErrMailboxCrowded
-	}
-
 	return mbox, nil
 }
 
 //FreeMailbox removes a mailbox listing from the application memory.
 //Does not remove it from the database
 func (a Application) FreeMailbox(id string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
 	_, ok := a.Mailboxes[id]
 	if ok {
 		delete(a.Mailboxes, id)
 	}
 }
 
-//Cleanup updates and removes mailboxes and nameplates as
-//needed via timeouts.
-func (a *Application) Cleanup(since int64) error {
+//CleanupCounts holds how much a cleaning pass removed
+type CleanupCounts struct {
+	Mailboxes  int64
+	Sides      int64 //Sides that were still open, and so pruned
+	Messages   int64
+	Nameplates int64
+}
+
+//Add totals the counts from another pass into these
+func (c *CleanupCounts) Add(o CleanupCounts) {
+	c.Mailboxes += o.Mailboxes
+	c.Sides += o.Sides
+	c.Messages += o.Messages
+	c.Nameplates += o.Nameplates
+}
+
+//queryEach runs the query in the transaction and calls fn for
+//each row, the rows are closed before it returns
+func queryEach(tx *sql.Tx, fn func(*sql.Rows) error, query string, args ...interface{}) error {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := fn(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+//expiredMailboxes selects the IDs of this application's mailboxes
+//that have not been updated since the time
+const expiredMailboxes = `SELECT id FROM mailboxes WHERE app_id=$1 AND updated<=$2`
+
+//Cleanup removes the mailboxes that went quiet, their nameplates,
+//messages and sides cascading with them, within a single
+//transaction. Sides still open are counted as pruned, and once
+//removed each is written to the usage log as closed with the pruney
+//mood. Listening clients are told their mailbox expired, and it is
+//freed from memory.
+//Returns the counts of what was removed
+func (a *Application) Cleanup(since int64) (CleanupCounts, error) {
+	var counts CleanupCounts
 	if db.Get() == nil {
-		return db.ErrNotOpen
+		return counts, db.ErrNotOpen
 	}
 	log.Infof("cleaning up application %s", a.ID)
 
 	//Touch boxes if someone is listening
 	//^ great comment, I know
+	a.lock.Lock()
 	for _, mbox := range a.Mailboxes {
 		if mbox.HasListeners() {
 			log.Infof("touching %s because of listeners", mbox.ID)
 			mbox.Touch()
 		}
 	}
+	a.lock.Unlock()
 
-	//Prep to clean old mailboxes
-	oldMboxes := make([]string, 0)
-	{ //Scope for the defer
-		rows, err := db.Get().Query("SELECT * FROM mailboxes WHERE app_id=$1", a.ID)
-		if err != nil && err != sql.ErrNoRows {
-			log.Err("getting mailboxes for application Cleanup", err)
-			return err
-		}
-		defer rows.Close()
-		for rows.Next() {
-			mbox := mailboxRaw{}
-			if err := rows.Scan(&mbox.id, &mbox.appID, &mbox.updated, &mbox.forNameplate); err != nil {
-				log.Err("scanning mailbox for application Cleanup", err)
-				return err
-			}
-
-			if mbox.updated <= since {
-				oldMboxes = append(oldMboxes, mbox.id)
-			}
-		}
-		if err := rows.Err(); err != nil {
-			log.Err("scanning mailbox rows for application Cleanup", err)
-			return err
-		}
+	//On SQLite the isolation level is ignored, the IMMEDIATE transaction
+	//holding the write lock from the start is what keeps the selected
+	//mailboxes from changing. On PostgreSQL it reads from one snapshot
+	//and fails if another relay changes an expired mailbox underneath
+	tx, err := db.Get().BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead})
+	if err != nil {
+		return counts, err
 	}
 
-	//Prep to clean old nameplates
-	oldNameplates := make([]int, 0)
-	{ //Scope for the defer
-		rows, err := db.Get().Query(`SELECT * FROM nameplates WHERE app_id=$1`, a.ID)
-		if err != nil && err != sql.ErrNoRows {
-			log.Err("selecting nameplates for application Cleanup", err)
-			return err
-		}
-		defer rows.Close()
-		for rows.Next() {
-			np := nameplate{}
-			if err := rows.Scan(&np.id, &np.appID, &np.name, &np.mailboxID, &np.requestID); err != nil {
-				log.Err("scanning nameplate for application Cleanup", err)
-				return err
-			}
-
-			found := false
-			for _, mid := range oldMboxes {
-				if mid == np.mailboxID {
-					found = true
-					break
-				}
-			}
-
-			if found {
-				oldNameplates = append(oldNameplates, np.id)
-			}
-		}
-		if err := rows.Err(); err != nil {
-			log.Err("scanning nameplate rows for application Cleanup", err)
+	expired := make([]string, 0)
+	err = queryEach(tx, func(rows *sql.Rows) error {
+		var id string
+		if err := rows.Scan(&id); err != nil {
 			return err
 		}
+		expired = append(expired, id)
+		return nil
+	}, expiredMailboxes, a.ID, since)
+	if err != nil {
+		tx.Rollback()
+		log.Err("selecting expired mailboxes for application Cleanup", err)
+		return counts, err
 	}
 
-	//Clear out old nameplates
-	for _, np := range oldNameplates {
-		if _, err := db.Get().Exec(`DELETE FROM nameplate_sides WHERE nameplate_id=$1`, np); err != nil {
-			log.Err("deleting nameplate sides for application Cleanup", err)
+	//Sides still open are pruned rather than closed, when
+	//they were added is kept for the usage log
+	pruned := make([]int64, 0)
+	err = queryEach(tx, func(rows *sql.Rows) error {
+		var added int64
+		if err := rows.Scan(&added); err != nil {
 			return err
 		}
+		pruned = append(pruned, added)
+		return nil
+	}, `SELECT added FROM mailbox_sides WHERE opened=true AND mailbox_id IN (`+expiredMailboxes+`)`, a.ID, since)
+	if err != nil {
+		tx.Rollback()
+		log.Err("selecting pruned sides for application Cleanup", err)
+		return counts, err
+	}
+	counts.Sides = int64(len(pruned))
 
-		if _, err := db.Get().Exec(`DELETE FROM nameplates WHERE id=$1`, np); err != nil {
-			log.Err("deleting nameplates for application Cleanup", err)
-			return err
-		}
+	//Everything else is removed along with the mailboxes, so it is counted first
+	row := tx.QueryRow(`SELECT
+		(SELECT COUNT(*) FROM messages WHERE mailbox_id IN (`+expiredMailboxes+`)),
+		(SELECT COUNT(*) FROM nameplates WHERE mailbox_id IN (`+expiredMailboxes+`))`, a.ID, since)
+	if err = row.Scan(&counts.Messages, &counts.Nameplates); err != nil {
+		tx.Rollback()
+		log.Err("counting expired rows for application Cleanup", err)
+		return counts, err
+	}
 
-		log.Infof("cleaned nameplate %d", np)
+	res, err := tx.Exec(`DELETE FROM mailboxes WHERE app_id=$1 AND updated<=$2`, a.ID, since)
+	if err != nil {
+		tx.Rollback()
+		log.Err("deleting mailboxes for application Cleanup", err)
+		return counts, err
 	}
+	counts.Mailboxes, _ = res.RowsAffected()
 
-	//Clear out old mailboxes
-	for _, mbid := range oldMboxes {
-		if _, err := db.Get().Exec(`DELETE FROM messages WHERE mailbox_id=$1`, mbid); err != nil {
-			log.Err("deleting messages for application Cleanup", err)
-			return err
-		}
+	if err = tx.Commit(); err != nil {
+		log.Err("committing application Cleanup", err)
+		return counts, err
+	}
 
-		if _, err := db.Get().Exec(`DELETE FROM mailbox_sides WHERE mailbox_id=$1`, mbid); err != nil {
-			log.Err("deleting mailbox sides for application Cleanup", err)
-			return err
+	//Only now are they really gone, here and on the other relays
+	for _, id := range expired {
+		if mbox := a.mailbox(id); mbox != nil {
+			mbox.stopAllListeners(ErrMailboxExpired)
+			a.FreeMailbox(id)
 		}
 
-		if _, err := db.Get().Exec(`DELETE FROM mailboxes WHERE id=$1`, mbid); err != nil {
-			log.Err("deleting mailbox for application Cleanup", err)
-			return err
+		if a.publish != nil {
+			a.publish(MailboxEvent{Kind: EventExpired, AppID: a.ID, MailboxID: id})
 		}
+	}
 
-		log.Infof("cleaned mailbox %s", mbid)
+	now := time.Now()
+	for _, added := range pruned {
+		log.Usage(log.UsageEvent{
+			Event:    log.UsageClose,
+			AppID:    a.ID,
+			Mood:     MoodPruney,
+			Duration: now.Sub(time.Unix(added, 0)).Seconds(),
+		})
 	}
 
-	return nil
+	if counts.Mailboxes > 0 {
+		LogInfof(nil, "cleaned %d mailboxes (%d sides %s), %d messages and %d nameplates for application %s",
+			counts.Mailboxes, counts.Sides, MoodPruney, counts.Messages, counts.Nameplates, a.ID)
+	}
+	return counts, nil
 }
 
 //StillInUse returns true if the application (by ID) is still
@@ -513,13 +709,13 @@ func (a Application) StillInUse() bool {
 	}
 
 	var inUse bool
-	row := db.Get().QueryRow(`SELECT COUNT(*)>0 FROM mailboxes WHERE app_id=$1`, a.ID)
+	row := db.Reader().QueryRow(`SELECT COUNT(*)>0 FROM mailboxes WHERE app_id=$1`, a.ID)
 	row.Scan(&inUse)
 	if inUse {
 		return true
 	}
 
-	row = db.Get().QueryRow(`SELECT COUNT(*)>0 FROM nameplates WHERE app_id=$1`, a.ID)
+	row = db.Reader().QueryRow(`SELECT COUNT(*)>0 FROM nameplates WHERE app_id=$1`, a.ID)
 	row.Scan(&inUse)
 	if inUse {
 		return true
@@ -0,0 +1,416 @@
+package relay
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/chris-pikul/go-wormhole-server/db"
+	"github.com/chris-pikul/go-wormhole-server/log"
+	"github.com/chris-pikul/go-wormhole/errs"
+	"github.com/chris-pikul/go-wormhole/msg"
+	"github.com/sirupsen/logrus"
+)
+
+func TestClaimNameplate(t *testing.T) {
+	defer setupRelay(t)()
+
+	first := newTestClient(t, "side1")
+	if err := first.HandleClaim(msg.Claim{Nameplate: "4"}); err != nil {
+		t.Fatal(err)
+	}
+	mbid := claimed(first)
+	if mbid == "" {
+		t.Fatal("first side was not sent the mailbox")
+	}
+
+	second := newTestClient(t, "side2")
+	if err := second.HandleClaim(msg.Claim{Nameplate: "4"}); err != nil {
+		t.Fatal(err)
+	} else if claimed(second) != mbid {
+		t.Error("second side was given a different mailbox")
+	}
+
+	//Reconnecting with the same side claims it again
+	again := newTestClient(t, "side1")
+	if err := again.HandleClaim(msg.Claim{Nameplate: "4"}); err != nil {
+		t.Errorf("re-claim by the same side failed: %s", err)
+	} else if claimed(again) != mbid {
+		t.Error("re-claim was given a different mailbox")
+	}
+
+	third := newTestClient(t, "side3")
+	if err := third.HandleClaim(msg.Claim{Nameplate: "4"}); err != errs.ErrNameplateCrowded {
+		t.Errorf("expected a third side to be crowded, got %v", err)
+	}
+
+	//The crowding side should not have taken a place
+	if err := second.HandleOpen(msg.Open{Mailbox: mbid}); err != nil {
+		t.Errorf("opening the mailbox after a crowded claim failed: %s", err)
+	}
+
+	if err := first.HandleRelease(msg.Release{Nameplate: "4"}); err != nil {
+		t.Fatal(err)
+	}
+
+	reclaim := newTestClient(t, "side1")
+	if err := reclaim.HandleClaim(msg.Claim{Nameplate: "4"}); err != errs.ErrReclaimNameplate {
+		t.Errorf("expected a released side to be refused as reclaimed, got %v", err)
+	}
+}
+
+func TestClaimReleasedNameplate(t *testing.T) {
+	defer setupRelay(t)()
+
+	first := newTestClient(t, "side1")
+	if err := first.HandleClaim(msg.Claim{Nameplate: "7"}); err != nil {
+		t.Fatal(err)
+	}
+	mbid := claimed(first)
+
+	if err := first.HandleRelease(msg.Release{}); err != nil {
+		t.Fatal(err)
+	}
+
+	//Releasing the last claim frees the nameplate for a new wormhole
+	second := newTestClient(t, "side2")
+	if err := second.HandleClaim(msg.Claim{Nameplate: "7"}); err != nil {
+		t.Fatal(err)
+	} else if claimed(second) == mbid {
+		t.Error("freed nameplate should get a new mailbox")
+	}
+}
+
+func TestCreateNameplateRace(t *testing.T) {
+	defer setupRelay(t)()
+
+	app := service.GetApp(testAppID)
+	first, err := app.createNameplate("8", "side1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Losing the race to create it gives back the winners nameplate
+	second, err := app.createNameplate("8", "side2")
+	if err != nil {
+		t.Fatal(err)
+	} else if second.id != first.id || second.mailboxID != first.mailboxID {
+		t.Errorf("expected the existing nameplate %+v, got %+v", first, second)
+	}
+
+	var nameplates, mailboxes int
+	db.Get().QueryRow(`SELECT COUNT(*) FROM nameplates`).Scan(&nameplates)
+	db.Get().QueryRow(`SELECT COUNT(*) FROM mailboxes`).Scan(&mailboxes)
+	if nameplates != 1 || mailboxes != 1 {
+		t.Errorf("expected a single nameplate and mailbox, found %d and %d", nameplates, mailboxes)
+	}
+}
+
+func TestDeleteMailboxCascades(t *testing.T) {
+	defer setupRelay(t)()
+
+	c := newTestClient(t, "side1")
+	if err := c.HandleClaim(msg.Claim{Nameplate: "9"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.HandleOpen(msg.Open{Mailbox: claimed(c)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.HandleAdd(msg.Add{Phase: "pake", Body: "00"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Mailbox.Delete(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, table := range []string{"mailbox_sides", "messages", "nameplates", "nameplate_sides"} {
+		var n int
+		db.Get().QueryRow(`SELECT COUNT(*) FROM ` + table).Scan(&n)
+		if n != 0 {
+			t.Errorf("expected %s to be emptied with the mailbox, found %d rows", table, n)
+		}
+	}
+}
+
+func TestClaimNameplateConcurrent(t *testing.T) {
+	defer setupRelay(t)()
+
+	//Only two of the sides claiming at once may get in
+	const sides = 8
+	clients := make([]*Client, sides)
+	for i := range clients {
+		clients[i] = newTestClient(t, "side"+strconv.Itoa(i))
+	}
+
+	results := make(chan error, sides)
+	for i, c := range clients {
+		go func(c *Client, side string) {
+			_, err := c.App.ClaimNameplate("9", side)
+			results <- err
+		}(c, "side"+strconv.Itoa(i))
+	}
+
+	claims := 0
+	for range clients {
+		if err := <-results; err == nil {
+			claims++
+		} else if err != errs.ErrNameplateCrowded {
+			t.Errorf("unexpected error claiming: %v", err)
+		}
+	}
+	if claims != 2 {
+		t.Errorf("expected 2 sides to claim the nameplate, %d did", claims)
+	}
+
+	var n int
+	db.Get().QueryRow(`SELECT COUNT(*) FROM nameplate_sides`).Scan(&n)
+	if n != 2 {
+		t.Errorf("expected 2 nameplate sides, found %d", n)
+	}
+}
+
+func TestCleanupExpiresMailbox(t *testing.T) {
+	defer setupRelay(t)()
+
+	c := newTestClient(t, "side1")
+	if err := c.HandleClaim(msg.Claim{Nameplate: "5"}); err != nil {
+		t.Fatal(err)
+	}
+	mbid := claimed(c)
+	if err := c.HandleOpen(msg.Open{Mailbox: mbid}); err != nil {
+		t.Fatal(err)
+	}
+
+	//Everything is older than the future
+	counts, err := c.App.Cleanup(time.Now().Unix() + 10)
+	if err != nil {
+		t.Fatal(err)
+	} else if counts != (CleanupCounts{Mailboxes: 1, Sides: 1, Nameplates: 1}) {
+		t.Errorf("unexpected cleanup counts %+v", counts)
+	}
+
+	var expired bool
+	for len(c.sendBuffer) > 0 {
+		if m, ok := (<-c.sendBuffer).(msg.Error); ok && m.Error == ErrMailboxExpired.Error() {
+			expired = true
+		}
+	}
+	if !expired {
+		t.Error("listening client was not told the mailbox expired")
+	}
+
+	if c.Mailbox != nil || c.Listening {
+		t.Error("client still holds the expired mailbox")
+	} else if _, ok := c.App.Mailboxes[mbid]; ok {
+		t.Error("expired mailbox was not freed from memory")
+	}
+
+	var remaining int
+	if err := db.Get().QueryRow(`SELECT COUNT(*) FROM mailboxes WHERE id=$1`, mbid).Scan(&remaining); err != nil {
+		t.Fatal(err)
+	} else if remaining != 0 {
+		t.Error("expired mailbox was left in the database")
+	}
+
+	if err := c.HandleAdd(msg.Add{Phase: "pake", Body: "00"}); err != errs.ErrOpenFirst {
+		t.Errorf("adding to an expired mailbox should need an open first, got %v", err)
+	}
+}
+
+func TestCleanupWhileClosing(t *testing.T) {
+	defer setupRelay(t)()
+
+	c := newTestClient(t, "side1")
+	if err := c.HandleClaim(msg.Claim{Nameplate: "8"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.HandleOpen(msg.Open{Mailbox: claimed(c)}); err != nil {
+		t.Fatal(err)
+	}
+
+	//Expiry comes from the cleaning goroutine, while the client
+	//goroutine is still using the mailbox
+	done := make(chan error)
+	go func() {
+		_, err := c.App.Cleanup(time.Now().Unix() + 10)
+		done <- err
+	}()
+
+	if err := c.HandleClose(msg.Close{Mood: "happy"}); err != nil && err != errs.ErrCloseOpenFirst {
+		t.Errorf("closing while the mailbox expired failed with %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if c.mailbox() != nil {
+		t.Error("client still holds the mailbox")
+	}
+}
+
+//seedExpired fills the database with expired mailboxes, each with
+//a nameplate, two sides and a few messages
+func seedExpired(b *testing.B, count int) {
+	tx, err := db.Get().Begin()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for i := 0; i < count; i++ {
+		mbid := generateMailboxID()
+		tx.Exec(`INSERT INTO mailboxes (app_id, id, for_nameplate, updated) VALUES ($1, $2, true, 0)`, testAppID, mbid)
+		tx.Exec(`INSERT INTO nameplates (app_id, name, mailbox_id) VALUES ($1, $2, $3)`, testAppID, strconv.Itoa(i), mbid)
+		var npid int64
+		tx.QueryRow(`SELECT id FROM nameplates WHERE mailbox_id=$1`, mbid).Scan(&npid)
+
+		seq := 0
+		for _, side := range []string{"side1", "side2"} {
+			tx.Exec(`INSERT INTO nameplate_sides (nameplate_id, claimed, side, added) VALUES ($1, true, $2, 0)`, npid, side)
+			tx.Exec(`INSERT INTO mailbox_sides (mailbox_id, opened, side, added) VALUES ($1, true, $2, 0)`, mbid, side)
+			for _, phase := range []string{"pake", "version"} {
+				seq++
+				tx.Exec(`INSERT INTO messages (id, app_id, mailbox_id, side, phase, body, server_rx, seq)
+					VALUES ($1, $2, $3, $4, $5, '00', 0, $6)`, side+phase, testAppID, mbid, side, phase, seq)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+//cleanupRowByRow removes the expired mailboxes the way cleaning did
+//before it was set-based, one statement per row, as the baseline
+//for BenchmarkCleanup
+func cleanupRowByRow(appID string, since int64) (int, error) {
+	mailboxes := make([]string, 0)
+	rows, err := db.Get().Query(`SELECT id, updated FROM mailboxes WHERE app_id=$1`, appID)
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var id string
+		var updated int64
+		if err := rows.Scan(&id, &updated); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if updated <= since {
+			mailboxes = append(mailboxes, id)
+		}
+	}
+	rows.Close()
+
+	expired := make(map[string]bool)
+	for _, id := range mailboxes {
+		expired[id] = true
+	}
+
+	nameplates := make([]int64, 0)
+	rows, err = db.Get().Query(`SELECT id, mailbox_id FROM nameplates WHERE app_id=$1`, appID)
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var id int64
+		var mbid string
+		if err := rows.Scan(&id, &mbid); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if expired[mbid] {
+			nameplates = append(nameplates, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range nameplates {
+		if _, err := db.Get().Exec(`DELETE FROM nameplate_sides WHERE nameplate_id=$1`, id); err != nil {
+			return 0, err
+		}
+		if _, err := db.Get().Exec(`DELETE FROM nameplates WHERE id=$1`, id); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, mbid := range mailboxes {
+		sides := make([]string, 0)
+		rows, err := db.Get().Query(`SELECT side FROM mailbox_sides WHERE mailbox_id=$1 AND opened=true`, mbid)
+		if err != nil {
+			return 0, err
+		}
+		for rows.Next() {
+			var side string
+			if err := rows.Scan(&side); err != nil {
+				rows.Close()
+				return 0, err
+			}
+			sides = append(sides, side)
+		}
+		rows.Close()
+
+		for _, side := range sides {
+			_, err := db.Get().Exec(`UPDATE mailbox_sides SET opened=false, mood=$1 WHERE mailbox_id=$2 AND side=$3`,
+				MoodPruney, mbid, side)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		for _, stmt := range []string{
+			`DELETE FROM messages WHERE mailbox_id=$1`,
+			`DELETE FROM mailbox_sides WHERE mailbox_id=$1`,
+			`DELETE FROM mailboxes WHERE id=$1`,
+		} {
+			if _, err := db.Get().Exec(stmt, mbid); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return len(mailboxes), nil
+}
+
+//BenchmarkCleanup compares cleaning 1000 expired mailboxes with
+//Cleanup against the row by row baseline, such as with
+//"benchstat -col /impl"
+func BenchmarkCleanup(b *testing.B) {
+	b.Run("impl=rowByRow", func(b *testing.B) {
+		defer setupRelay(b)()
+		log.Get().SetLevel(logrus.WarnLevel)
+
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			seedExpired(b, 1000)
+			b.StartTimer()
+
+			removed, err := cleanupRowByRow(testAppID, time.Now().Unix())
+			if err != nil {
+				b.Fatal(err)
+			} else if removed != 1000 {
+				b.Fatalf("cleanup missed mailboxes, removed %d", removed)
+			}
+		}
+	})
+
+	b.Run("impl=set", func(b *testing.B) {
+		defer setupRelay(b)()
+		log.Get().SetLevel(logrus.WarnLevel)
+		app := service.GetApp(testAppID)
+
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			seedExpired(b, 1000)
+			b.StartTimer()
+
+			counts, err := app.Cleanup(time.Now().Unix())
+			if err != nil {
+				b.Fatal(err)
+			} else if counts.Mailboxes != 1000 || counts.Messages != 4000 {
+				b.Fatalf("cleanup missed rows %+v", counts)
+			}
+		}
+	})
+}
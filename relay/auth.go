@@ -0,0 +1,113 @@
+package relay
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/chris-pikul/go-wormhole-server/config"
+)
+
+const (
+	//AuthRequiredMessage is the welcome error sent to clients that
+	//did not provide credentials to a private relay
+	AuthRequiredMessage = "this server requires authentication, please check your client configuration"
+
+	//AuthInvalidMessage is the welcome error sent to clients that
+	//provided credentials that are not known
+	AuthInvalidMessage = "the provided authentication token is not valid for this server"
+
+	//AuthScopeMessage is the welcome error sent to clients whose
+	//credentials do not cover the application they bind to
+	AuthScopeMessage = "the provided authentication token is not valid for this application"
+)
+
+//bindCredential holds the optional extra field that may be
+//included in bind messages to authenticate
+type bindCredential struct {
+	Token string `json:"token"`
+}
+
+//authRequired returns true if the relay is private
+func authRequired() bool {
+	return len(config.Opts.Relay.Tokens) > 0
+}
+
+//findCredential looks up the configured token options matching
+//the token. Every token is compared in constant time so the
+//lookup does not leak how much of a token was right.
+//Returns nil if the token is not known
+func findCredential(token string) *config.TokenOptions {
+	if token == "" {
+		return nil
+	}
+
+	var found *config.TokenOptions
+	for i, tkn := range config.Opts.Relay.Tokens {
+		if subtle.ConstantTimeCompare([]byte(tkn.Token), []byte(token)) == 1 {
+			found = &config.Opts.Relay.Tokens[i]
+		}
+	}
+	return found
+}
+
+//requestToken returns the token presented on the websocket upgrade,
+//either in the "token" query parameter, or as a bearer token
+func requestToken(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+
+	return bearerToken(r)
+}
+
+//bearerToken returns the bearer token from the Authorization header
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+
+	return ""
+}
+
+//bindToken returns the token field from a raw bind message
+func bindToken(src []byte) string {
+	var cred bindCredential
+	if err := json.Unmarshal(src, &cred); err != nil {
+		return ""
+	}
+	return cred.Token
+}
+
+//authorize checks the client may bind to the application ID,
+//refusing the client if it can not.
+//Returns an error for the bind message if refused
+func (c *Client) authorize(appID string, src []byte) error {
+	if !authRequired() {
+		return nil
+	}
+
+	//Credentials in the bind take over from the upgrade
+	if token := bindToken(src); token != "" {
+		c.credential = findCredential(token)
+		if c.credential == nil {
+			LogInfo(c, "refusing client with invalid credentials in bind")
+			c.refuse(AuthInvalidMessage)
+			return ErrUnauthorized
+		}
+	}
+
+	if c.credential == nil {
+		LogInfo(c, "refusing client without credentials")
+		c.refuse(AuthRequiredMessage)
+		return ErrUnauthorized
+	} else if !c.credential.Allows(appID) {
+		LogInfof(c, "refusing client with credentials not scoped to app %s", appID)
+		c.refuse(AuthScopeMessage)
+		return ErrUnauthorized
+	}
+
+	return nil
+}
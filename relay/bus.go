@@ -0,0 +1,83 @@
+package relay
+
+import (
+	"sync"
+)
+
+const (
+	//EventMessage is published when a message was added to a mailbox
+	EventMessage = "message"
+
+	//EventExpired is published when cleaning removed a mailbox
+	EventExpired = "expired"
+)
+
+//MailboxEvent tells the other relays sharing the database
+//that something happened to a mailbox they may be serving
+//clients of. The event only points at the mailbox, the
+//relays read what changed from the database themselves
+type MailboxEvent struct {
+	Kind      string
+	Node      string //The relay the event came from
+	AppID     string
+	MailboxID string
+	Seq       int64 //Sequence of the message, if a message event
+}
+
+//BusHandler is a callback function that receives the
+//events published on a bus
+type BusHandler func(MailboxEvent)
+
+//Bus passes mailbox events between relays. Every event
+//published is delivered to the handlers of all the relays,
+//including the one that published it
+type Bus interface {
+	//Publish sends the event to all the relays on the bus
+	Publish(MailboxEvent) error
+
+	//Subscribe registers a handler for the events on the bus
+	Subscribe(BusHandler)
+
+	//Close stops delivering events
+	Close() error
+}
+
+//LocalBus is a Bus for relays running in the same process.
+//Events are delivered to the handlers before Publish returns
+type LocalBus struct {
+	handlers []BusHandler
+	lock     sync.RWMutex
+}
+
+//NewLocalBus returns a new, empty, in-process bus
+func NewLocalBus() *LocalBus {
+	return &LocalBus{}
+}
+
+//Publish delivers the event to every handler
+func (b *LocalBus) Publish(ev MailboxEvent) error {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	for _, h := range b.handlers {
+		h(ev)
+	}
+	return nil
+}
+
+//Subscribe registers the handler for the events on the bus
+func (b *LocalBus) Subscribe(handler BusHandler) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.handlers = append(b.handlers, handler)
+}
+
+//Close removes all the handlers
+func (b *LocalBus) Close() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.handlers = nil
+	return nil
+}
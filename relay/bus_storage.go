@@ -0,0 +1,181 @@
+package relay
+
+import (
+	"sync"
+	"time"
+
+	"github.com/chris-pikul/go-wormhole-server/db"
+	"github.com/chris-pikul/go-wormhole-server/log"
+)
+
+const (
+	//eventWindow is how far back each poll of the storage bus
+	//looks. Events can be committed out of order, or with the
+	//clocks of the relays slightly apart, so anything this recent
+	//is read again and the ones already delivered are skipped
+	eventWindow = 10 * time.Second
+
+	//eventRetention is how long events are kept in the database
+	eventRetention = time.Minute
+)
+
+//StorageBus is a Bus passing events through the database the
+//relays share. Events are written to the mailbox_events table,
+//which each relay polls for the ones it has not seen yet
+type StorageBus struct {
+	interval time.Duration
+
+	handlers []BusHandler
+	lock     sync.RWMutex
+
+	seen   map[int64]int64 //Event IDs delivered, with when they were created
+	pruned time.Time
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+//NewStorageBus returns a bus polling the database for new
+//events at the interval. Events already in the database
+//are not delivered
+func NewStorageBus(interval time.Duration) (*StorageBus, error) {
+	if db.Get() == nil {
+		return nil, db.ErrNotOpen
+	}
+
+	b := &StorageBus{
+		interval: interval,
+		seen:     make(map[int64]int64),
+		pruned:   time.Now(),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	//Everything there now is old news
+	if err := b.poll(false); err != nil {
+		return nil, err
+	}
+
+	go b.run()
+	return b, nil
+}
+
+//Publish writes the event to the database, where the relays
+//will pick it up on their next poll
+func (b *StorageBus) Publish(ev MailboxEvent) error {
+	stmt, err := db.Stmt(`INSERT INTO mailbox_events (node, kind, app_id, mailbox_id, seq, created)
+		VALUES ($1, $2, $3, $4, $5, $6)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(ev.Node, ev.Kind, ev.AppID, ev.MailboxID, ev.Seq, millis(time.Now()))
+	return err
+}
+
+//Subscribe registers the handler for the events on the bus
+func (b *StorageBus) Subscribe(handler BusHandler) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.handlers = append(b.handlers, handler)
+}
+
+//Close stops polling, and waits for the last poll to finish
+func (b *StorageBus) Close() error {
+	b.once.Do(func() {
+		close(b.stop)
+	})
+	<-b.done
+	return nil
+}
+
+func (b *StorageBus) run() {
+	defer close(b.done)
+
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+			if err := b.poll(true); err != nil {
+				log.Err("failed to poll the storage bus", err)
+			}
+
+			if time.Since(b.pruned) >= eventRetention {
+				b.prune()
+			}
+		}
+	}
+}
+
+//poll reads the events within the window, delivering the
+//ones not seen before if deliver is true
+func (b *StorageBus) poll(deliver bool) error {
+	since := millis(time.Now().Add(-eventWindow))
+
+	rows, err := db.Reader().Query(`SELECT id, node, kind, app_id, mailbox_id, seq, created
+		FROM mailbox_events WHERE created>=$1 ORDER BY id ASC`, since)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	events := make([]MailboxEvent, 0)
+	for rows.Next() {
+		var id, created int64
+		ev := MailboxEvent{}
+		if err := rows.Scan(&id, &ev.Node, &ev.Kind, &ev.AppID, &ev.MailboxID, &ev.Seq, &created); err != nil {
+			return err
+		}
+
+		if _, ok := b.seen[id]; ok {
+			continue
+		}
+		b.seen[id] = created
+		events = append(events, ev)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	//Those older than the window won't be read again
+	for id, created := range b.seen {
+		if created < since {
+			delete(b.seen, id)
+		}
+	}
+
+	if !deliver {
+		return nil
+	}
+
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	for _, ev := range events {
+		for _, h := range b.handlers {
+			h(ev)
+		}
+	}
+	return nil
+}
+
+//prune removes the events every relay has had time to read
+func (b *StorageBus) prune() {
+	b.pruned = time.Now()
+
+	before := millis(b.pruned.Add(-eventRetention))
+	if _, err := db.Get().Exec(`DELETE FROM mailbox_events WHERE created<$1`, before); err != nil {
+		log.Err("failed to prune the storage bus events", err)
+	}
+}
+
+//millis returns the time in milliseconds since the epoch
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
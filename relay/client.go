@@ -3,6 +3,8 @@ package relay
 import (
 	"encoding/json"
 	"fmt"
+	"net"
+	"sync"
 	"time"
 
 	"github.com/chris-pikul/go-wormhole-server/config"
@@ -26,6 +28,10 @@ const (
 type Client struct {
 	conn       *websocket.Conn
 	sendBuffer chan msg.IMessage
+	remoteAddr net.IP
+	hangup     chan struct{}
+	credential *config.TokenOptions
+	refused    bool
 
 	App       *Application
 	Side      string
@@ -39,18 +45,32 @@ type Client struct {
 	Closed    bool
 
 	listenerHandle int
+
+	//lock guards Mailbox, Listening, listenerHandle and the send
+	//buffer closing, as the mailbox expiring changes them from the
+	//goroutine cleaning it. Taken after the mailbox's own lock
+	lock   sync.Mutex
+	closed bool
+
+	connected time.Time //When the client connected, for the usage log
+	opened    time.Time //When the mailbox was opened, for the usage log
 }
 
 //Close terminates the client connection and cleans up resources it had
 //bound.
 func (c *Client) Close() {
-	if c.Mailbox != nil {
-		if c.Listening || c.listenerHandle > 0 {
-			c.Mailbox.RemoveListener(c.listenerHandle)
-		}
+	c.lock.Lock()
+	mbox, listening, handle := c.Mailbox, c.Listening, c.listenerHandle
+	c.lock.Unlock()
+
+	if mbox != nil && listening {
+		mbox.RemoveListener(handle)
 	}
 
+	c.lock.Lock()
+	c.closed = true
 	close(c.sendBuffer)
+	c.lock.Unlock()
 
 	if c.conn != nil {
 		c.conn.Close()
@@ -59,7 +79,7 @@ func (c *Client) Close() {
 }
 
 //IsBound returns true if the client has already bound to the server
-func (c Client) IsBound() bool {
+func (c *Client) IsBound() bool {
 	return c.App != nil && c.Side != ""
 }
 
@@ -137,6 +157,23 @@ func (c *Client) watchWrites() {
 			if err := w.Close(); err != nil { //Writer failure
 				return
 			}
+		case <-c.hangup: //Client was refused, flush what is queued and close
+			for len(c.sendBuffer) > 0 {
+				msgObj, ok := <-c.sendBuffer
+				if !ok || c.conn == nil {
+					return
+				}
+
+				c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+				if err := c.conn.WriteJSON(msgObj); err != nil {
+					return
+				}
+			}
+
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, ""))
+			LogDebug(c, "hung up on refused client")
+			return
 		case <-ticker.C: //Ping check for keeping the connection alive
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
@@ -148,6 +185,21 @@ func (c *Client) watchWrites() {
 	}
 }
 
+//outboundMessage is a mailbox message delivered to the client,
+//along with the server timing upstream clients use for diagnostics
+type outboundMessage struct {
+	msg.MailboxMessage
+
+	ServerRX float64 `json:"server_rx"`
+	ServerTX float64 `json:"server_tx"`
+}
+
+//serverTime returns the current time in seconds,
+//as used for server_rx and server_tx
+func serverTime() float64 {
+	return float64(time.Now().UnixNano()) / float64(time.Second)
+}
+
 func (c *Client) mailboxMessage(mmsg MailboxMessage) {
 	if c.conn == nil {
 		return
@@ -155,16 +207,33 @@ func (c *Client) mailboxMessage(mmsg MailboxMessage) {
 
 	LogDebugf(c, "received mailbox event for message %s", mmsg.ID)
 
-	c.sendBuffer <- msg.MailboxMessage{
-		Message: msg.NewServerMessage(msg.TypeMessage),
-		Side:    mmsg.Side,
-		Phase:   mmsg.Phase,
-		Body:    mmsg.Body,
-		MsgID:   mmsg.ID,
+	c.sendBuffer <- newOutboundMessage(mmsg)
+}
+
+//newOutboundMessage wraps the mailbox message for delivery,
+//stamped with the time it is sent
+func newOutboundMessage(mmsg MailboxMessage) outboundMessage {
+	return outboundMessage{
+		MailboxMessage: msg.MailboxMessage{
+			Message: msg.NewServerMessage(msg.TypeMessage),
+			Side:    mmsg.Side,
+			Phase:   mmsg.Phase,
+			Body:    mmsg.Body,
+			MsgID:   mmsg.ID,
+		},
+
+		ServerRX: mmsg.ServerRX,
+		ServerTX: serverTime(),
 	}
 }
 
-func (c *Client) stopMailboxMessages() {
+//stopMailboxMessages is called with the mailbox's lock held, from
+//whichever goroutine stopped it, so it only touches the client under
+//its lock and never waits on the send buffer
+func (c *Client) stopMailboxMessages(reason error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	if c.Mailbox == nil {
 		return
 	}
@@ -173,15 +242,79 @@ func (c *Client) stopMailboxMessages() {
 
 	c.Listening = false
 	c.listenerHandle = 0
+
+	if reason != nil {
+		//The mailbox is gone, so the client is told why
+		//and can no longer use it
+		id := c.Mailbox.ID
+		LogInfof(c, "mailbox %s removed: %s", id, reason.Error())
+		c.Mailbox = nil
+
+		if c.closed {
+			return
+		}
+
+		select {
+		case c.sendBuffer <- msg.Error{
+			Message: msg.NewServerMessage(msg.TypeError),
+			Error:   reason.Error(),
+		}:
+		default:
+			LogWarnf(c, "send buffer is full, could not tell the client mailbox %s was removed", id)
+		}
+	}
+}
+
+//mailbox returns the mailbox the client has open, if it
+//has not been removed from under it
+func (c *Client) mailbox() *Mailbox {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.Mailbox
 }
 
 //OnConnect is called when the client has successfully been registered
 //to the server
 func (c *Client) OnConnect() {
+	info := service.Welcome
+	if InMaintenance() {
+		//New clients are told to come back later
+		reason := MaintenanceMessage()
+		info.Error = &reason
+		LogInfo(c, "welcomed client with maintenance error")
+	}
+
+	logUsage(c, log.UsageConnect, "", 0)
+
 	c.sendBuffer <- msg.Welcome{
 		Message: msg.NewServerMessage(msg.TypeWelcome),
 
-		Info: service.Welcome,
+		Info: info,
+	}
+}
+
+//refuse sends the welcome message again carrying the reason as
+//an error, which clients treat as fatal and display to the user.
+//The connection is hung up once the current message is handled
+func (c *Client) refuse(reason string) {
+	info := service.Welcome
+	info.Error = &reason
+
+	c.refused = true
+	c.sendBuffer <- msg.Welcome{
+		Message: msg.NewServerMessage(msg.TypeWelcome),
+
+		Info: info,
+	}
+}
+
+//hangUp signals the writer to close the connection after
+//flushing any messages already queued
+func (c *Client) hangUp() {
+	select {
+	case c.hangup <- struct{}{}:
+	default:
 	}
 }
 
@@ -192,6 +325,10 @@ func (c *Client) OnConnect() {
 //and validation here as necessary. So this will be broken
 //down into the message types.
 func (c *Client) OnMessage(src []byte) {
+	if c.refused {
+		return //Waiting to be hung up
+	}
+
 	mt, im, err := msg.ParseClient(src)
 	if err != nil {
 		c.messageError(err, src)
@@ -222,7 +359,9 @@ func (c *Client) OnMessage(src []byte) {
 		c.HandlePing(m)
 	case msg.TypeBind:
 		m := im.(msg.Bind)
-		e = c.HandleBind(m)
+		if e = c.authorize(m.AppID, src); e == nil {
+			e = c.HandleBind(m)
+		}
 	case msg.TypeList:
 		m := im.(msg.List)
 		e = c.HandleList(m)
@@ -251,6 +390,10 @@ func (c *Client) OnMessage(src []byte) {
 	if e != nil {
 		c.messageError(e, src)
 	}
+
+	if c.refused {
+		c.hangUp()
+	}
 }
 
 //when bad or malformed messages appear, this method
@@ -266,7 +409,9 @@ func (c *Client) messageError(err error, orig []byte) {
 	}
 
 	//Mask the error if it isn't a client one
-	if _, ok := err.(errs.ClientError); !ok {
+	switch err.(type) {
+	case errs.ClientError, ClientError:
+	default:
 		LogErr(c, "internal error found during messageError before going to client", err)
 		err = errs.ErrInternal
 	}
@@ -296,25 +441,42 @@ func (c *Client) HandleBind(m msg.Bind) error {
 		return errs.ErrBindAppID
 	} else if m.Side == "" {
 		return errs.ErrBindSide
+	} else if !config.Opts.Relay.AppAllowed(m.AppID) {
+		LogInfof(c, "refusing bind to unknown app %s", m.AppID)
+		return ErrUnknownApp
 	}
 
 	c.App = service.GetApp(m.AppID)
 	c.Side = m.Side
 
 	LogInfof(c, "bound client to app %s and side %s", m.AppID, m.Side)
+	logUsage(c, log.UsageBind, "", 0)
+
+	//Applications with their own MOTD get welcomed again with it
+	if motd := config.Opts.Relay.Apps[m.AppID].WelcomeMOTD; motd != "" {
+		info := service.Welcome
+		info.MOTD = &motd
+
+		c.sendBuffer <- msg.Welcome{
+			Message: msg.NewServerMessage(msg.TypeWelcome),
+
+			Info: info,
+		}
+	}
 	return nil
 }
 
 //HandleList handles list commands from the client
 //who would like to know the available nameplates.
 //This is optional for whether the server will allow
-//it via the AllowList relay server configuration option.
+//it via the AllowList relay server configuration option,
+//or the application's policy.
 //If this option is not available, an empty list is returned
 //back to the client
 func (c *Client) HandleList(m msg.List) error {
 	//Safe to assume we are bound
 
-	if config.Opts.Relay.AllowList == false {
+	if *c.App.Policy().AllowList == false {
 		//Not allowed, reply empty
 		c.sendBuffer <- msg.Nameplates{
 			Message:    msg.NewServerMessage(msg.TypeNameplates),
@@ -354,6 +516,10 @@ func (c *Client) HandleAllocate(m msg.Allocate) error {
 		return errs.ErrAlreadyAllocated
 	}
 
+	if InMaintenance() {
+		return ErrMaintenance
+	}
+
 	id, err := c.App.AllocateNameplate(c.Side)
 	if err != nil {
 		LogErr(c, "failed to allocate nameplate for allocate command", err)
@@ -361,6 +527,7 @@ func (c *Client) HandleAllocate(m msg.Allocate) error {
 	}
 
 	c.Allocated = true
+	logUsage(c, log.UsageAllocate, "", 0)
 
 	c.sendBuffer <- msg.Allocated{
 		Message:   msg.NewServerMessage(msg.TypeAllocated),
@@ -382,7 +549,19 @@ func (c *Client) HandleClaim(m msg.Claim) error {
 		return errs.ErrClaimNameplate
 	}
 
-	mboxID, err := c.App.ClaimNameplate(m.Nameplate, m.Nameplate)
+	if InMaintenance() {
+		//Joining an existing nameplate is finishing a wormhole,
+		//only brand new ones are refused
+		exists, err := c.App.HasNameplate(m.Nameplate)
+		if err != nil {
+			LogErr(c, "failed to check nameplate for claim command", err)
+			return err
+		} else if !exists {
+			return ErrMaintenance
+		}
+	}
+
+	mboxID, err := c.App.ClaimNameplate(m.Nameplate, c.Side)
 	if err != nil {
 		LogErr(c, "failed to claim nameplate for claim command", err)
 		return err
@@ -390,6 +569,7 @@ func (c *Client) HandleClaim(m msg.Claim) error {
 
 	c.Claimed = true
 	c.Nameplate = m.Nameplate
+	logUsage(c, log.UsageClaim, "", 0)
 
 	c.sendBuffer <- msg.Claimed{
 		Message: msg.NewServerMessage(msg.TypeClaimed),
@@ -436,7 +616,7 @@ func (c *Client) HandleRelease(m msg.Release) error {
 //mailbox (by ID) for reading. Will also bind the listeners
 //for event callbacks.
 func (c *Client) HandleOpen(m msg.Open) error {
-	if c.Mailbox != nil {
+	if c.mailbox() != nil {
 		return errs.ErrAlreadyOpened
 	}
 
@@ -449,10 +629,29 @@ func (c *Client) HandleOpen(m msg.Open) error {
 		LogErr(c, "failed to open mailbox for open command", err)
 		return err
 	}
+	c.lock.Lock()
 	c.Mailbox = mbox
+	c.lock.Unlock()
+	recordActivity(c)
 
-	//Bind the event callbacks!
-	c.listenerHandle = mbox.AddListener(c.mailboxMessage, c.stopMailboxMessages)
+	//Bind the event callbacks, which also sends the
+	//messages already waiting in the mailbox
+	handle, err := mbox.Listen(c.mailboxMessage, c.stopMailboxMessages)
+	if err != nil {
+		LogErr(c, "failed to listen to mailbox for open command", err)
+		return err
+	}
+
+	//Unless it expired in the meantime
+	c.lock.Lock()
+	if c.Mailbox == mbox {
+		c.listenerHandle = handle
+		c.Listening = true
+	}
+	c.lock.Unlock()
+
+	c.opened = time.Now()
+	logUsage(c, log.UsageOpen, "", 0)
 
 	return nil
 }
@@ -463,7 +662,8 @@ func (c *Client) HandleOpen(m msg.Open) error {
 //the specified mailbox. Which of course means, it echos back
 //immediately
 func (c *Client) HandleAdd(m msg.Add) error {
-	if c.Mailbox == nil {
+	mbox := c.mailbox()
+	if mbox == nil {
 		return errs.ErrOpenFirst
 	}
 
@@ -476,20 +676,24 @@ func (c *Client) HandleAdd(m msg.Add) error {
 	mmsg := MailboxMessage{
 		ID:        m.ID,
 		AppID:     c.App.ID,
-		MailboxID: c.Mailbox.ID,
+		MailboxID: mbox.ID,
 		Side:      c.Side,
 
 		Phase: m.Phase,
 		Body:  m.Body,
 
-		ServerRX: time.Now().Unix(),
+		ServerRX: serverTime(),
 	}
 
-	err := c.Mailbox.AddMessage(mmsg)
-	if err != nil {
+	err := mbox.AddMessage(mmsg)
+	if err == ErrMessageQuota {
+		LogInfof(c, "mailbox %s reached its message quota", mbox.ID)
+		return err
+	} else if err != nil {
 		LogErr(c, "failed to add message for add command", err)
 		return err
 	}
+	recordActivity(c)
 
 	return nil
 }
@@ -502,38 +706,48 @@ func (c *Client) HandleClose(m msg.Close) error {
 		return errs.ErrAlreadyClosed
 	}
 
+	mbox := c.mailbox()
 	if m.Mailbox != "" {
-		if c.Mailbox != nil && c.Mailbox.ID != m.Mailbox {
+		if mbox != nil && mbox.ID != m.Mailbox {
 			return errs.ErrCloseMailbox
 		}
-	} else if c.Mailbox == nil {
+	} else if mbox == nil {
 		return errs.ErrCloseOpenFirst
 	}
 
-	if c.Mailbox == nil {
-		mbox, err := c.App.OpenMailbox(m.Mailbox, c.Side)
+	if mbox == nil {
+		var err error
+		mbox, err = c.App.OpenMailbox(m.Mailbox, c.Side)
 		if err != nil {
 			LogErr(c, "failed to open mailbox for command close", err)
 			return err
 		}
-
-		c.Mailbox = mbox
 	}
 
-	err := c.Mailbox.Close(c.Side, m.Mood)
+	err := mbox.Close(c.Side, m.Mood)
 	if err != nil {
 		LogErr(c, "failed to close mailbox for command close", err)
 		return err
 	}
 
-	if c.Listening {
-		c.Mailbox.RemoveListener(c.listenerHandle)
-		c.Listening = false
-	}
-
+	c.lock.Lock()
+	listening, handle := c.Listening, c.listenerHandle
 	c.Mailbox = nil
+	c.Listening = false
+	c.listenerHandle = 0
+	c.lock.Unlock()
+
+	if listening {
+		mbox.RemoveListener(handle)
+	}
 	c.Closed = true
 
+	var open time.Duration
+	if !c.opened.IsZero() {
+		open = time.Since(c.opened)
+	}
+	logUsage(c, log.UsageClose, m.Mood, open)
+
 	c.sendBuffer <- msg.Closed{
 		Message: msg.NewServerMessage(msg.TypeClosed),
 	}
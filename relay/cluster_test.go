@@ -0,0 +1,157 @@
+package relay
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+//testNode is a relay service sharing the test database,
+//with a listener on the mailbox it opened
+type testNode struct {
+	service *Service
+	app     *Application
+	mbox    *Mailbox
+
+	lock    sync.Mutex
+	msgs    []MailboxMessage
+	stopped error
+}
+
+//newTestNode starts a relay service attached to the bus, and opens
+//the mailbox with the side
+func newTestNode(t *testing.T, name string, bus Bus, mbid, side string) *testNode {
+	n := &testNode{
+		service: &Service{Apps: make(map[string]Application)},
+	}
+	n.service.Attach(name, bus)
+
+	var err error
+	n.app = n.service.GetApp(testAppID)
+	if n.mbox, err = n.app.OpenMailbox(mbid, side); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = n.mbox.Listen(func(m MailboxMessage) {
+		n.lock.Lock()
+		n.msgs = append(n.msgs, m)
+		n.lock.Unlock()
+	}, func(reason error) {
+		n.lock.Lock()
+		n.stopped = reason
+		n.lock.Unlock()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+//received returns the sequences of the messages the node's listener was sent
+func (n *testNode) received() []int64 {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	seqs := make([]int64, 0, len(n.msgs))
+	for _, m := range n.msgs {
+		seqs = append(seqs, m.Seq)
+	}
+	return seqs
+}
+
+func (n *testNode) add(t *testing.T, side, phase string) {
+	err := n.mbox.AddMessage(MailboxMessage{
+		AppID:     testAppID,
+		MailboxID: n.mbox.ID,
+		Side:      side,
+		Phase:     phase,
+		Body:      "00",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func sameSeqs(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestClusterLocalBus(t *testing.T) {
+	defer setupRelay(t)()
+
+	bus := NewLocalBus()
+	mbid := generateMailboxID()
+	first := newTestNode(t, "first", bus, mbid, "side1")
+	second := newTestNode(t, "second", bus, mbid, "side2")
+
+	first.add(t, "side1", "pake")
+	second.add(t, "side2", "pake")
+	first.add(t, "side1", "version")
+
+	//Both sides see every message once, in the same order
+	want := []int64{1, 2, 3}
+	if got := first.received(); !sameSeqs(got, want) {
+		t.Errorf("first node was sent %v, expected %v", got, want)
+	}
+	if got := second.received(); !sameSeqs(got, want) {
+		t.Errorf("second node was sent %v, expected %v", got, want)
+	}
+
+	//Joining late replays what is there, and nothing twice
+	third := newTestNode(t, "third", bus, mbid, "side2")
+	first.add(t, "side1", "3")
+	if got := third.received(); !sameSeqs(got, []int64{1, 2, 3, 4}) {
+		t.Errorf("late node was sent %v", got)
+	}
+
+	//Expiring on one relay stops the listeners on the others
+	if _, err := first.app.Cleanup(time.Now().Unix() + 10); err != nil {
+		t.Fatal(err)
+	}
+	second.lock.Lock()
+	stopped := second.stopped
+	second.lock.Unlock()
+	if stopped != ErrMailboxExpired {
+		t.Errorf("second node listener was stopped with %v, expected expiry", stopped)
+	} else if second.app.mailbox(mbid) != nil {
+		t.Error("second node did not free the expired mailbox")
+	}
+}
+
+func TestClusterStorageBus(t *testing.T) {
+	defer setupRelay(t)()
+
+	mbid := generateMailboxID()
+	nodes := make([]*testNode, 2)
+	for i, name := range []string{"first", "second"} {
+		bus, err := NewStorageBus(10 * time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bus.Close()
+
+		nodes[i] = newTestNode(t, name, bus, mbid, "side"+name)
+	}
+
+	nodes[0].add(t, "sidefirst", "pake")
+	nodes[1].add(t, "sidesecond", "pake")
+
+	want := []int64{1, 2}
+	deadline := time.Now().Add(5 * time.Second)
+	for _, n := range nodes {
+		for !sameSeqs(n.received(), want) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := n.received(); !sameSeqs(got, want) {
+			t.Errorf("node %s was sent %v, expected %v", n.service.Node, got, want)
+		}
+	}
+}
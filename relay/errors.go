@@ -0,0 +1,42 @@
+package relay
+
+//ClientError is an error that is safe to send back to
+//the client as-is. It complements the errs.ClientError
+//values from the protocol package with errors that are
+//specific to this server
+type ClientError string
+
+//Error returns the error message
+func (e ClientError) Error() string {
+	return string(e)
+}
+
+var (
+	//ErrMaintenance is returned when a new nameplate is requested
+	//while the server is in maintenance mode
+	ErrMaintenance = ClientError("server is in maintenance mode, no new nameplates are being accepted")
+
+	//ErrUnauthorized is returned when a client binds to a private
+	//relay without valid credentials for the application
+	ErrUnauthorized = ClientError("unauthorized")
+
+	//ErrUnknownApp is returned when a client binds to an application
+	//ID that is not in the relay's allowed applications
+	ErrUnknownApp = ClientError("unknown application ID, this server does not serve it")
+
+	//ErrMessageQuota is returned when adding a message to a mailbox
+	//that already holds the application's maximum number of messages
+	ErrMessageQuota = ClientError("mailbox message quota reached")
+
+	//ErrDuplicatePhase is returned in strict mode when a side adds
+	//a message for a phase it has already sent
+	ErrDuplicatePhase = ClientError("phase was already sent by this side")
+
+	//ErrMailboxExpired is sent to clients listening on a mailbox
+	//that was removed by cleaning after going quiet for too long
+	ErrMailboxExpired = ClientError("mailbox timed out and was removed by the server")
+
+	//ErrMessageSequence is returned when a message could not be given
+	//a sequence number, as other relays kept taking them first
+	ErrMessageSequence = ClientError("mailbox is too busy, message was not added")
+)
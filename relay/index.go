@@ -1,22 +1,32 @@
 package relay
 
 import (
+	"io/ioutil"
 	"net/http"
-    "text/template"
-    "io/ioutil"
+	"text/template"
+
+	"github.com/chris-pikul/go-wormhole-server/log"
 )
 
 var indexTemplate *template.Template
 
-func init() {
-    tmpl, err := ioutil.ReadFile("index.html")
-    if err != nil {
-        panic(err)
-    }
+//loadIndex reads the index page template from the working directory.
+//The relay still works without it, only the index page is missing
+func loadIndex() {
+	tmpl, err := ioutil.ReadFile("index.html")
+	if err != nil {
+		log.Warnf("index page will not be served, could not read index.html: %s", err.Error())
+		return
+	}
 
-    indexTemplate = template.Must(template.New("").Parse(string(tmpl)))
+	indexTemplate = template.Must(template.New("").Parse(string(tmpl)))
 }
 
 func handleIndex(w http.ResponseWriter, r *http.Request) {
+	if indexTemplate == nil {
+		http.NotFound(w, r)
+		return
+	}
+
 	indexTemplate.Execute(w, "ws://"+r.Host+"/v1")
-}
\ No newline at end of file
+}
@@ -8,15 +8,38 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+//logUsage writes the client's event to the usage log. The duration
+//is left out if zero
+func logUsage(c *Client, event, mood string, dur time.Duration) {
+	if !log.UsageEnabled() {
+		return
+	}
+
+	ev := log.UsageEvent{
+		Event:    event,
+		Mood:     mood,
+		Duration: dur.Seconds(),
+	}
+
+	if c.remoteAddr != nil {
+		ev.Address = c.remoteAddr.String()
+	}
+	if c.App != nil {
+		ev.AppID = c.App.ID
+	}
+
+	log.Usage(ev)
+}
+
 func prepLog(c *Client) *logrus.Entry {
-	var l = log.Get().WithField("usage", "relay")
+	var l = logrus.NewEntry(log.Get())
 	if config.Opts.Logging.BlurTimes > 1 {
 		l = l.WithTime(time.Now().Truncate(time.Duration(config.Opts.Logging.BlurTimes) * time.Second))
 	}
 
-	if c != nil && c.conn != nil {
+	if c != nil && c.remoteAddr != nil {
 		if config.Opts.Logging.ShowAddress {
-			l = l.WithField("remote-addr", c.conn.RemoteAddr())
+			l = l.WithField("remote-addr", c.remoteAddr.String())
 		}
 	}
 
@@ -24,9 +47,9 @@ func prepLog(c *Client) *logrus.Entry {
 }
 
 //LogDebug is a convenience wrapper for logging
-//usage statistics given the relay server settings
+//messages about the client given the relay server settings
 func LogDebug(c *Client, args ...interface{}) {
-	if config.Opts == nil || !config.Opts.Logging.Usage {
+	if config.Opts == nil {
 		return
 	}
 
@@ -34,9 +57,9 @@ func LogDebug(c *Client, args ...interface{}) {
 }
 
 //LogDebugf is a convenience wrapper for logging
-//usage statistics given the relay server settings
+//messages about the client given the relay server settings
 func LogDebugf(c *Client, fmt string, args ...interface{}) {
-	if config.Opts == nil || !config.Opts.Logging.Usage {
+	if config.Opts == nil {
 		return
 	}
 
@@ -44,9 +67,9 @@ func LogDebugf(c *Client, fmt string, args ...interface{}) {
 }
 
 //LogInfo is a convenience wrapper for logging
-//usage statistics given the relay server settings
+//messages about the client given the relay server settings
 func LogInfo(c *Client, args ...interface{}) {
-	if config.Opts == nil || !config.Opts.Logging.Usage {
+	if config.Opts == nil {
 		return
 	}
 
@@ -54,9 +77,9 @@ func LogInfo(c *Client, args ...interface{}) {
 }
 
 //LogInfof is a convenience wrapper for logging
-//usage statistics given the relay server settings
+//messages about the client given the relay server settings
 func LogInfof(c *Client, fmt string, args ...interface{}) {
-	if config.Opts == nil || !config.Opts.Logging.Usage {
+	if config.Opts == nil {
 		return
 	}
 
@@ -64,7 +87,7 @@ func LogInfof(c *Client, fmt string, args ...interface{}) {
 }
 
 //LogWarn is a convenience wrapper for logging warnings
-//with usage statistics
+//about the client
 func LogWarn(c *Client, fmt string, args ...interface{}) {
 	if config.Opts == nil {
 		return
@@ -74,7 +97,7 @@ func LogWarn(c *Client, fmt string, args ...interface{}) {
 }
 
 //LogWarnf is a convenience wrapper for logging warnings
-//with usage statistics
+//about the client
 func LogWarnf(c *Client, fmt string, args ...interface{}) {
 	if config.Opts == nil {
 		return
@@ -84,7 +107,7 @@ func LogWarnf(c *Client, fmt string, args ...interface{}) {
 }
 
 //LogError is a convenience wrapper for logging errors
-//with usage statistics
+//about the client
 func LogError(c *Client, fmt string, args ...interface{}) {
 	if config.Opts == nil {
 		return
@@ -94,7 +117,7 @@ func LogError(c *Client, fmt string, args ...interface{}) {
 }
 
 //LogErrorf is a convenience wrapper for logging errors
-//with usage statistics
+//about the client
 func LogErrorf(c *Client, fmt string, args ...interface{}) {
 	if config.Opts == nil {
 		return
@@ -104,7 +127,7 @@ func LogErrorf(c *Client, fmt string, args ...interface{}) {
 }
 
 //LogErr is a convenience wrapper for logging errors
-//with usage statistics
+//about the client
 func LogErr(c *Client, msg string, err error) {
 	if config.Opts == nil {
 		return
@@ -0,0 +1,94 @@
+package relay
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chris-pikul/go-wormhole-server/log"
+	"github.com/chris-pikul/go-wormhole/msg"
+)
+
+func TestUsageLog(t *testing.T) {
+	defer setupRelay(t)()
+
+	dir, err := ioutil.TempDir("", "wormhole-usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "usage.log")
+	opts := log.DefaultOptions
+	opts.Level = log.LevelWarn
+	opts.Usage.Sinks = []log.SinkOptions{{Type: log.SinkFile, Path: path}}
+	if err := log.Initialize(opts); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		opts.Usage = log.UsageOptions{}
+		log.Initialize(opts)
+	}()
+
+	c := newTestClient(t, "side1")
+	if err := c.HandleClaim(msg.Claim{Nameplate: "6"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.HandleOpen(msg.Open{Mailbox: claimed(c)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.HandleClose(msg.Close{Mood: "happy"}); err != nil {
+		t.Fatal(err)
+	}
+
+	//A side left open until cleaning is closed as pruned
+	other := newTestClient(t, "side2")
+	if err := other.HandleClaim(msg.Claim{Nameplate: "7"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.HandleOpen(msg.Open{Mailbox: claimed(other)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.App.Cleanup(time.Now().Unix() + 10); err != nil {
+		t.Fatal(err)
+	}
+	log.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	events := make([]log.UsageEvent, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var ev log.UsageEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, ev)
+	}
+
+	expected := []string{log.UsageBind, log.UsageClaim, log.UsageOpen, log.UsageClose,
+		log.UsageBind, log.UsageClaim, log.UsageOpen, log.UsageClose}
+	if len(events) != len(expected) {
+		t.Fatalf("expected the events %v, got %+v", expected, events)
+	}
+	for i, ev := range events {
+		if ev.Event != expected[i] || ev.AppID != testAppID {
+			t.Errorf("expected a %s event for the app, got %+v", expected[i], ev)
+		}
+	}
+
+	if closed := events[3]; closed.Mood != "happy" {
+		t.Errorf("close event did not carry the mood: %+v", closed)
+	}
+	if pruned := events[len(events)-1]; pruned.Mood != MoodPruney {
+		t.Errorf("cleaning did not close the open side as pruned: %+v", pruned)
+	}
+}
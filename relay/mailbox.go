@@ -5,7 +5,9 @@ import (
 	"sync"
 	"time"
 
+	"github.com/chris-pikul/go-wormhole-server/config"
 	"github.com/chris-pikul/go-wormhole-server/db"
+	"github.com/chris-pikul/go-wormhole-server/log"
 )
 
 //MailboxListener is a callback function that receives
@@ -18,8 +20,9 @@ type MailboxListener func(MailboxMessage)
 //When the service needs to remove a mailbox with
 //an attached listener, this callback is called
 //to alert the listener that they are going to loose
-//their hook.
-type MailboxListenerStop func()
+//their hook. The reason is nil unless the client should
+//be told why, such as the mailbox expiring.
+type MailboxListenerStop func(reason error)
 
 //Mailbox holds an association with an application
 //as well as its on ID. Here the client messages
@@ -34,6 +37,12 @@ type Mailbox struct {
 
 	lock       sync.Mutex
 	listenerID int
+
+	addLock   sync.Mutex
+	delivered int64 //Sequence of the last message broadcast to the listeners
+
+	//publish sends mailbox events to the other relays
+	publish func(MailboxEvent)
 }
 
 //MailboxMessage is an individual entry
@@ -45,7 +54,12 @@ type MailboxMessage struct {
 	Side      string
 	Phase     string
 	Body      string
-	ServerRX  int64
+
+	//ServerRX is when the message was received, in seconds
+	ServerRX float64
+
+	//Seq orders the messages within the mailbox
+	Seq int64
 }
 
 type mailboxRaw struct {
@@ -63,6 +77,21 @@ type mailboxSide struct {
 	mood      string
 }
 
+//strictPhases returns true if each side may only
+//send each phase once
+func strictPhases() bool {
+	return config.Opts != nil && config.Opts.Relay.StrictPhases
+}
+
+//messageQuota returns the most messages a mailbox of the
+//application may hold, or 0 if there is no limit
+func messageQuota(appID string) uint {
+	if config.Opts == nil {
+		return 0
+	}
+	return config.Opts.Relay.Policy(appID).MaxMessages
+}
+
 //NewMailbox returns a new mailbox address
 //with the provided information
 func NewMailbox(id, appID string) *Mailbox {
@@ -82,7 +111,12 @@ func (m *Mailbox) Touch() error {
 		return db.ErrNotOpen
 	}
 
-	_, err := db.Get().Exec(`UPDATE mailboxes SET updated=$2 WHERE id=$1`, m.ID, time.Now().Unix())
+	stmt, err := db.Stmt(`UPDATE mailboxes SET updated=$1 WHERE id=$2`)
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(time.Now().Unix(), m.ID)
 	return err
 }
 
@@ -92,15 +126,28 @@ func (m *Mailbox) Open(side string) error {
 		return db.ErrNotOpen
 	}
 
-	msides := mailboxSide{}
-	row := db.Get().QueryRow(`SELECT * FROM mailbox_sides WHERE mailbox_id=$1 AND side=$2`, m.ID, side)
-	if err := row.Scan(&msides.mailboxID, &msides.opened, &msides.side, &msides.added, &msides.mood); err != nil {
-		if err == sql.ErrNoRows {
-			_, err = db.Get().Exec(`INSERT INTO mailbox_sides (mailbox_id, opened, side, added) 
-				VALUES ($1, true, $3, $4)`, m.ID, side, time.Now().Unix())
-			if err != nil {
-				return err
-			}
+	//Re-opening from the same side is allowed
+	stmt, err := db.Stmt(`INSERT INTO mailbox_sides (mailbox_id, opened, side, added)
+		VALUES ($1, true, $2, $3) ON CONFLICT DO NOTHING`)
+	if err != nil {
+		return err
+	}
+
+	res, err := stmt.Exec(m.ID, side, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		stmt, err := db.Stmt(`UPDATE mailbox_sides SET opened=true WHERE mailbox_id=$1 AND side=$2`)
+		if err != nil {
+			return err
+		}
+
+		if _, err := stmt.Exec(m.ID, side); err != nil {
+			return err
 		}
 	}
 
@@ -115,35 +162,31 @@ func (m *Mailbox) Close(side string, mood string) error {
 	var err error
 
 	//Find the mailbox object from DB
-	var updated int
-	var forNameplate bool
-	row := db.Get().QueryRow(`SELECT * FROM mailboxes WHERE app_id=$2 AND id=$1`, m.ID, m.AppID)
-	if err = row.Scan(&updated, &forNameplate); err != nil {
-		if err == sql.ErrNoRows { //Bail early since the mailbox doesn't even exist
-			return nil
-		}
+	var exists bool
+	row := db.Get().QueryRow(`SELECT COUNT(*)>0 FROM mailboxes WHERE app_id=$1 AND id=$2`, m.AppID, m.ID)
+	if err = row.Scan(&exists); err != nil && err != sql.ErrNoRows {
 		return err
+	} else if !exists { //Bail early since the mailbox doesn't even exist
+		return nil
 	}
 
 	//Get the side that matches ours
-	msides := mailboxSide{}
-	row = db.Get().QueryRow(`SELECT * FROM mailbox_sides WHERE mailbox_id=$1 AND side=$2`, m.ID, side)
-	if err := row.Scan(&msides.mailboxID, &msides.opened, &msides.side, &msides.added, &msides.mood); err != nil {
-		if err == sql.ErrNoRows { //Bail early since we wheren't in this box anyways
-			return nil
-		}
+	row = db.Get().QueryRow(`SELECT COUNT(*)>0 FROM mailbox_sides WHERE mailbox_id=$1 AND side=$2`, m.ID, side)
+	if err = row.Scan(&exists); err != nil && err != sql.ErrNoRows {
 		return err
+	} else if !exists { //Bail early since we wheren't in this box anyways
+		return nil
 	}
 
 	//Clear this side
-	_, err = db.Get().Exec(`UPDATE mailbox_sides SET opened=false, mood=$3 WHERE mailbox_id=$1 AND side=$2`, m.ID, side, mood)
+	_, err = db.Get().Exec(`UPDATE mailbox_sides SET opened=false, mood=$1 WHERE mailbox_id=$2 AND side=$3`, mood, m.ID, side)
 	if err != nil {
 		return err
 	}
 
 	//Check if any are open
 	var opened bool
-	row = db.Get().QueryRow(`SELECT COUNT(*)>0 FROM mailbox_sides WHERE mailbox_id=$1`, m.ID)
+	row = db.Get().QueryRow(`SELECT COUNT(*)>0 FROM mailbox_sides WHERE mailbox_id=$1 AND opened=true`, m.ID)
 	if err = row.Scan(&opened); err != nil && err != sql.ErrNoRows {
 		return err
 	}
@@ -161,13 +204,7 @@ func (m *Mailbox) Delete() error {
 	if db.Get() == nil {
 		return db.ErrNotOpen
 	}
-	//Probably should transaction this, but it is SQLite after all
-	if _, err := db.Get().Exec(`DELETE FROM messages WHERE mailbox_id=$1`, m.ID); err != nil {
-		return err
-	}
-	if _, err := db.Get().Exec(`DELETE FROM mailbox_sides WHERE mailbox_id=$1`, m.ID); err != nil {
-		return err
-	}
+	//Messages, sides and nameplates go with it
 	if _, err := db.Get().Exec(`DELETE FROM mailboxes WHERE id=$1`, m.ID); err != nil {
 		return err
 	}
@@ -179,21 +216,27 @@ func (m *Mailbox) Delete() error {
 
 //GetMessages returns the messages currently present in this mailbox
 func (m *Mailbox) GetMessages() ([]MailboxMessage, error) {
+	return m.messagesAfter(0)
+}
+
+//messagesAfter returns the messages in this mailbox with a
+//sequence past the one given, in sequence order
+func (m *Mailbox) messagesAfter(seq int64) ([]MailboxMessage, error) {
 	var msgs []MailboxMessage
 
 	if db.Get() == nil {
 		return msgs, db.ErrNotOpen
 	}
 
-	rows, err := db.Get().Query(`SELECT * FROM messages WHERE app_id=$1 AND mailbox_id=$2
-		ORDER BY server_rx ASC`, m.AppID, m.ID)
+	rows, err := db.Reader().Query(`SELECT id, app_id, mailbox_id, side, phase, body, server_rx, seq
+		FROM messages WHERE app_id=$1 AND mailbox_id=$2 AND seq>$3 ORDER BY seq ASC`, m.AppID, m.ID, seq)
 	if err != nil {
 		return msgs, err
 	}
 	defer rows.Close()
 	for rows.Next() {
 		msg := MailboxMessage{}
-		err = rows.Scan(&msg.ID, &msg.AppID, &msg.MailboxID, &msg.Side, &msg.Phase, &msg.Body, &msg.ServerRX)
+		err = rows.Scan(&msg.ID, &msg.AppID, &msg.MailboxID, &msg.Side, &msg.Phase, &msg.Body, &msg.ServerRX, &msg.Seq)
 		if err != nil {
 			return msgs, err
 		}
@@ -208,23 +251,190 @@ func (m *Mailbox) GetMessages() ([]MailboxMessage, error) {
 	return msgs, nil
 }
 
-//AddMessage inserts a new message into the mailbox
+//MessageCount returns how many messages are in this mailbox
+func (m *Mailbox) MessageCount() (int, error) {
+	if db.Get() == nil {
+		return 0, db.ErrNotOpen
+	}
+
+	var count int
+	row := db.Reader().QueryRow(`SELECT COUNT(*) FROM messages WHERE app_id=$1 AND mailbox_id=$2`, m.AppID, m.ID)
+	if err := row.Scan(&count); err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	return count, nil
+}
+
+//maxSeqTries is how many times adding a message
+//tries for a free sequence number
+const maxSeqTries = 5
+
+//AddMessage inserts a new message into the mailbox.
+//Messages with an ID already in the mailbox are retransmits and
+//are dropped without error. A mailbox that holds the application's
+//MaxMessages refuses any more with ErrMessageQuota. In strict mode,
+//a second message from the same side for the same phase is refused
+//with ErrDuplicatePhase
 func (m *Mailbox) AddMessage(msg MailboxMessage) error {
 	if db.Get() == nil {
 		return db.ErrNotOpen
 	}
 
-	_, err := db.Get().Exec(`INSERT INTO messages (id, app_id, mailbox_id, side, phase, body, server_rx)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)`, msg.ID, msg.AppID, msg.MailboxID, msg.Side, msg.Phase, msg.Body, msg.ServerRX)
-	if err != nil {
+	seq, err := m.addMessage(msg)
+	if seq == 0 {
 		return err
 	}
 
-	m.broadcast(msg)
+	//The other relays take their add lock to catch up, so they
+	//are only told once ours is released
+	if m.publish != nil {
+		m.publish(MailboxEvent{Kind: EventMessage, AppID: m.AppID, MailboxID: m.ID, Seq: seq})
+	}
+	if err != nil {
+		return err
+	}
 
 	return m.Touch()
 }
 
+//addMessage inserts the message and broadcasts it under the add lock.
+//Returns the sequence it was given, or 0 if it was not added
+func (m *Mailbox) addMessage(msg MailboxMessage) (int64, error) {
+	m.addLock.Lock()
+	defer m.addLock.Unlock()
+
+	if msg.ID != "" {
+		stmt, err := db.Stmt(`SELECT COUNT(*)>0 FROM messages WHERE mailbox_id=$1 AND id=$2`)
+		if err != nil {
+			return 0, err
+		}
+
+		var exists bool
+		row := stmt.QueryRow(m.ID, msg.ID)
+		if err := row.Scan(&exists); err != nil && err != sql.ErrNoRows {
+			return 0, err
+		} else if exists {
+			log.Debugf("dropping retransmitted message %s in mailbox %s", msg.ID, m.ID)
+			return 0, nil
+		}
+	}
+
+	if max := messageQuota(m.AppID); max > 0 {
+		count, err := m.MessageCount()
+		if err != nil {
+			return 0, err
+		} else if count >= int(max) {
+			return 0, ErrMessageQuota
+		}
+	}
+
+	if strictPhases() {
+		stmt, err := db.Stmt(`SELECT COUNT(*)>0 FROM messages WHERE mailbox_id=$1 AND side=$2 AND phase=$3`)
+		if err != nil {
+			return 0, err
+		}
+
+		var exists bool
+		row := stmt.QueryRow(m.ID, msg.Side, msg.Phase)
+		if err := row.Scan(&exists); err != nil && err != sql.ErrNoRows {
+			return 0, err
+		} else if exists {
+			return 0, ErrDuplicatePhase
+		}
+	}
+
+	//Other relays sharing the database may take the same
+	//sequence first, in which case the next one is tried
+	inserted := false
+	for try := 0; try < maxSeqTries && !inserted; try++ {
+		stmt, err := db.Stmt(`SELECT COALESCE(MAX(seq), 0) FROM messages WHERE mailbox_id=$1`)
+		if err != nil {
+			return 0, err
+		}
+		if err := stmt.QueryRow(m.ID).Scan(&msg.Seq); err != nil && err != sql.ErrNoRows {
+			return 0, err
+		}
+		msg.Seq++
+
+		stmt, err = db.Stmt(`INSERT INTO messages (id, app_id, mailbox_id, side, phase, body, server_rx, seq)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8) ON CONFLICT DO NOTHING`)
+		if err != nil {
+			return 0, err
+		}
+
+		res, err := stmt.Exec(msg.ID, msg.AppID, msg.MailboxID, msg.Side, msg.Phase, msg.Body, msg.ServerRX, msg.Seq)
+		if err != nil {
+			return 0, err
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		inserted = n > 0
+	}
+	if !inserted {
+		return 0, ErrMessageSequence
+	}
+
+	//Broadcasting while still holding the add lock keeps
+	//the listeners receiving messages in sequence order.
+	//Messages other relays added in between go out first
+	return msg.Seq, m.catchUpLocked()
+}
+
+//catchUp broadcasts the messages added since the last
+//one the listeners were sent, such as by other relays
+func (m *Mailbox) catchUp() error {
+	m.addLock.Lock()
+	defer m.addLock.Unlock()
+
+	return m.catchUpLocked()
+}
+
+//catchUpLocked is catchUp for callers holding the add lock
+func (m *Mailbox) catchUpLocked() error {
+	msgs, err := m.messagesAfter(m.delivered)
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range msgs {
+		m.broadcast(msg)
+		m.delivered = msg.Seq
+	}
+	return nil
+}
+
+//Listen replays the messages already in the mailbox to the listener,
+//in sequence order, and then registers it for new ones. No message is
+//missed or repeated in between.
+//Returns an integer handle for de-registration
+func (m *Mailbox) Listen(listener MailboxListener, stopCallback MailboxListenerStop) (int, error) {
+	m.addLock.Lock()
+	defer m.addLock.Unlock()
+
+	//The listeners already here are sent anything new first,
+	//so the replay ends where they are at
+	if err := m.catchUpLocked(); err != nil {
+		return 0, err
+	}
+
+	msgs, err := m.GetMessages()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, msg := range msgs {
+		if msg.Seq > m.delivered {
+			break
+		}
+		listener(msg)
+	}
+
+	return m.AddListener(listener, stopCallback), nil
+}
+
 //AddListener registers a callback for mailbox messages
 //and returns an integer handle for de-registration
 func (m *Mailbox) AddListener(listener MailboxListener, stopCallback MailboxListenerStop) int {
@@ -253,11 +463,17 @@ func (m *Mailbox) RemoveListener(handle int) {
 //RemoveAllListeners calls the stop callback
 //on each listener, and then clears all the listners
 func (m *Mailbox) RemoveAllListeners() {
+	m.stopAllListeners(nil)
+}
+
+//stopAllListeners calls the stop callback with the reason
+//on each listener, and then clears all the listeners
+func (m *Mailbox) stopAllListeners(reason error) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
 	for _, cb := range m.stopListeners {
-		cb()
+		cb(reason)
 	}
 
 	m.listeners = make(map[int]MailboxListener)
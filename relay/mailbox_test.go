@@ -0,0 +1,215 @@
+package relay
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+
+	"github.com/chris-pikul/go-wormhole-server/config"
+	"github.com/chris-pikul/go-wormhole/msg"
+)
+
+//openTestMailbox returns a client with the nameplate claimed and its
+//mailbox opened
+func openTestMailbox(t *testing.T, side, nameplate string) *Client {
+	c := newTestClient(t, side)
+	if err := c.HandleClaim(msg.Claim{Nameplate: nameplate}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.HandleOpen(msg.Open{Mailbox: claimed(c)}); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+//listenTo counts the messages broadcast on the client's mailbox.
+//Broadcasts happen while adding, so the count is read after
+func listenTo(c *Client) *int {
+	broadcasts := 0
+	c.mailbox().AddListener(func(MailboxMessage) {
+		broadcasts++
+	}, func(error) {})
+	return &broadcasts
+}
+
+//addTestMessage sends the client's add command for the message
+func addTestMessage(c *Client, id, phase, body string) error {
+	return c.HandleAdd(msg.Add{Message: msg.Message{ID: id}, Phase: phase, Body: body})
+}
+
+func TestAddDuplicateID(t *testing.T) {
+	defer setupRelay(t)()
+
+	c := openTestMailbox(t, "side1", "10")
+	broadcasts := listenTo(c)
+	if err := addTestMessage(c, "m1", "pake", "00"); err != nil {
+		t.Fatal(err)
+	} else if *broadcasts != 1 {
+		t.Fatalf("expected the message to be broadcast once, was %d times", *broadcasts)
+	}
+
+	//A retransmit is dropped quietly, and not broadcast again
+	if err := addTestMessage(c, "m1", "pake", "00"); err != nil {
+		t.Errorf("retransmitted message was refused with %v", err)
+	}
+	if *broadcasts != 1 {
+		t.Errorf("retransmitted message was broadcast again, %d broadcasts", *broadcasts)
+	}
+	if count, err := c.mailbox().MessageCount(); err != nil {
+		t.Fatal(err)
+	} else if count != 1 {
+		t.Errorf("expected 1 message in the mailbox, found %d", count)
+	}
+}
+
+func TestAddDuplicatePhase(t *testing.T) {
+	defer setupRelay(t)()
+
+	c := openTestMailbox(t, "side1", "11")
+	broadcasts := listenTo(c)
+	if err := addTestMessage(c, "m1", "pake", "00"); err != nil {
+		t.Fatal(err)
+	}
+
+	//By default the same phase from the same side is allowed
+	if err := addTestMessage(c, "m2", "pake", "01"); err != nil {
+		t.Errorf("repeated phase was refused outside of strict mode with %v", err)
+	}
+
+	//Each test runs with its own copy of the options
+	config.Opts.Relay.StrictPhases = true
+
+	if err := addTestMessage(c, "m3", "pake", "02"); err != ErrDuplicatePhase {
+		t.Errorf("expected a repeated phase to be refused in strict mode, got %v", err)
+	}
+	if err := addTestMessage(c, "m4", "version", "03"); err != nil {
+		t.Errorf("new phase was refused in strict mode with %v", err)
+	}
+
+	if *broadcasts != 3 {
+		t.Errorf("expected 3 messages to be broadcast, were %d", *broadcasts)
+	}
+}
+
+func TestAddQuota(t *testing.T) {
+	defer setupRelay(t)()
+
+	config.Opts.Relay.Apps = map[string]config.AppPolicy{
+		testAppID: {MaxMessages: 2},
+	}
+
+	c := openTestMailbox(t, "side1", "13")
+	if err := addTestMessage(c, "m1", "pake", "00"); err != nil {
+		t.Fatal(err)
+	}
+	if err := addTestMessage(c, "m2", "version", "01"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := addTestMessage(c, "m3", "0", "02"); err != ErrMessageQuota {
+		t.Errorf("expected a full mailbox to refuse more messages, got %v", err)
+	}
+
+	//A retransmit is still dropped quietly when full
+	if err := addTestMessage(c, "m2", "version", "01"); err != nil {
+		t.Errorf("retransmitted message to a full mailbox was refused with %v", err)
+	}
+}
+
+func TestAddQuotaConcurrent(t *testing.T) {
+	defer setupRelay(t)()
+
+	config.Opts.Relay.Apps = map[string]config.AppPolicy{
+		testAppID: {MaxMessages: 1},
+	}
+
+	first := openTestMailbox(t, "side1", "14")
+	second := newTestClient(t, "side2")
+	if err := second.HandleClaim(msg.Claim{Nameplate: "14"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.HandleOpen(msg.Open{Mailbox: claimed(second)}); err != nil {
+		t.Fatal(err)
+	}
+
+	//Both sides add at once, only one may fit
+	results := make(chan error, 2)
+	for i, c := range []*Client{first, second} {
+		go func(c *Client, id string) {
+			results <- addTestMessage(c, id, "pake", "00")
+		}(c, "m"+strconv.Itoa(i))
+	}
+
+	added := 0
+	for i := 0; i < 2; i++ {
+		if err := <-results; err == nil {
+			added++
+		} else if err != ErrMessageQuota {
+			t.Error(err)
+		}
+	}
+	if added != 1 {
+		t.Errorf("expected 1 message to fit the quota, %d were added", added)
+	}
+}
+
+func TestMessagesOrderedBySeq(t *testing.T) {
+	defer setupRelay(t)()
+
+	c := openTestMailbox(t, "side1", "12")
+	mbox := c.mailbox()
+
+	//Received times can go backwards, such as between relays
+	//with skewed clocks, the sequence still decides the order
+	phases := []string{"pake", "version", "0"}
+	for i, phase := range phases {
+		err := mbox.AddMessage(MailboxMessage{
+			AppID:     testAppID,
+			MailboxID: mbox.ID,
+			Side:      "side1",
+			Phase:     phase,
+			Body:      "00",
+			ServerRX:  float64(1000 - i),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msgs, err := mbox.GetMessages()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(msgs) != len(phases) {
+		t.Fatalf("expected %d messages, found %d", len(phases), len(msgs))
+	}
+	for i, m := range msgs {
+		if m.Seq != int64(i+1) || m.Phase != phases[i] {
+			t.Errorf("message %d was %s with sequence %d", i, m.Phase, m.Seq)
+		}
+	}
+}
+
+func TestOutboundServerTiming(t *testing.T) {
+	rx := serverTime()
+	out := newOutboundMessage(MailboxMessage{ID: "m1", Side: "side1", Phase: "pake", Body: "00", ServerRX: rx})
+
+	data, err := json.Marshal(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := make(map[string]interface{})
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+
+	if fields["server_rx"] != rx {
+		t.Errorf("expected server_rx to be when it was received, %v, got %v", rx, fields["server_rx"])
+	}
+	if tx, ok := fields["server_tx"].(float64); !ok || tx < rx {
+		t.Errorf("expected server_tx to be when it was sent, after %v, got %v", rx, fields["server_tx"])
+	}
+	if fields["phase"] != "pake" || fields["side"] != "side1" {
+		t.Errorf("delivered message lost its fields: %s", data)
+	}
+}
@@ -0,0 +1,82 @@
+package relay
+
+import (
+	"sync"
+	"time"
+
+	"github.com/chris-pikul/go-wormhole-server/config"
+	"github.com/chris-pikul/go-wormhole-server/log"
+)
+
+//DefaultMaintenanceMessage is the welcome error sent to clients
+//during maintenance when the configuration does not provide one
+const DefaultMaintenanceMessage = "this server is undergoing maintenance and is not accepting new wormholes, please try again later"
+
+var (
+	maintenance         config.MaintenanceOptions
+	maintenanceOverride *bool
+	lockMaintenance     sync.RWMutex
+)
+
+//SetMaintenance replaces the maintenance settings, usually
+//after the configuration file has been reloaded.
+//Any manual override from ToggleMaintenance is cleared.
+func SetMaintenance(opts config.MaintenanceOptions) {
+	lockMaintenance.Lock()
+	maintenance = opts
+	maintenanceOverride = nil
+	lockMaintenance.Unlock()
+
+	log.Infof("maintenance settings updated, maintenance mode is now %s", maintenanceState(InMaintenance()))
+}
+
+//ToggleMaintenance manually flips the maintenance mode from whatever
+//it currently is. This overrides the configured schedule until the
+//settings are replaced again with SetMaintenance.
+//Returns the new state.
+func ToggleMaintenance() bool {
+	lockMaintenance.Lock()
+	state := !inMaintenance()
+	maintenanceOverride = &state
+	lockMaintenance.Unlock()
+
+	log.Infof("maintenance mode manually toggled %s", maintenanceState(state))
+	return state
+}
+
+//InMaintenance returns true if the relay is currently refusing
+//new wormholes
+func InMaintenance() bool {
+	lockMaintenance.RLock()
+	defer lockMaintenance.RUnlock()
+
+	return inMaintenance()
+}
+
+//inMaintenance is InMaintenance for callers already holding lockMaintenance
+func inMaintenance() bool {
+	if maintenanceOverride != nil {
+		return *maintenanceOverride
+	}
+
+	return maintenance.Active(time.Now())
+}
+
+//MaintenanceMessage returns the welcome error to send clients
+//while in maintenance mode
+func MaintenanceMessage() string {
+	lockMaintenance.RLock()
+	defer lockMaintenance.RUnlock()
+
+	if maintenance.Message != "" {
+		return maintenance.Message
+	}
+	return DefaultMaintenanceMessage
+}
+
+func maintenanceState(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
@@ -0,0 +1,41 @@
+package relay
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/chris-pikul/go-wormhole-server/config"
+)
+
+func TestToggleMaintenance(t *testing.T) {
+	SetMaintenance(config.MaintenanceOptions{})
+	defer SetMaintenance(config.MaintenanceOptions{})
+
+	if !ToggleMaintenance() || !InMaintenance() {
+		t.Fatal("toggling should turn maintenance on")
+	}
+	if ToggleMaintenance() || InMaintenance() {
+		t.Fatal("toggling again should turn maintenance off")
+	}
+
+	//Every toggle flips the state, so an even number of them
+	//at once must end up back where it started
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ToggleMaintenance()
+		}()
+	}
+	wg.Wait()
+
+	if InMaintenance() {
+		t.Error("concurrent toggles lost an update")
+	}
+
+	SetMaintenance(config.MaintenanceOptions{Enabled: true})
+	if !InMaintenance() {
+		t.Error("replacing the settings should clear the override")
+	}
+}
@@ -0,0 +1,54 @@
+package relay
+
+import (
+	"time"
+
+	"github.com/chris-pikul/go-wormhole-server/db"
+	"github.com/chris-pikul/go-wormhole-server/log"
+)
+
+//reconcile brings the persisted state in line with a relay that has
+//just started, and so has no connected clients. Sides left open by the
+//previous run are marked as no longer opened, while keeping their place
+//so they can re-open or re-claim when they return. The mailboxes are
+//touched so returning clients get the full expiration time to do so
+func reconcile() error {
+	if db.Get() == nil {
+		return db.ErrNotOpen
+	}
+
+	tx, err := db.Get().Begin()
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.Exec(`UPDATE mailbox_sides SET opened=false WHERE opened=true`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	sides, _ := res.RowsAffected()
+
+	res, err = tx.Exec(`UPDATE mailboxes SET updated=$1`, time.Now().Unix())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	mboxes, _ := res.RowsAffected()
+
+	var claims int64
+	row := tx.QueryRow(`SELECT COUNT(*) FROM nameplate_sides WHERE claimed=true`)
+	if err = row.Scan(&claims); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	if mboxes > 0 {
+		log.Infof("recovered %d mailboxes with %d open sides, and %d nameplate claims from the last run", mboxes, sides, claims)
+	}
+	return nil
+}
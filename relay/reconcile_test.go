@@ -0,0 +1,57 @@
+package relay
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chris-pikul/go-wormhole-server/db"
+	"github.com/chris-pikul/go-wormhole/msg"
+)
+
+func TestReconcile(t *testing.T) {
+	defer setupRelay(t)()
+
+	c := newTestClient(t, "side1")
+	if err := c.HandleClaim(msg.Claim{Nameplate: "3"}); err != nil {
+		t.Fatal(err)
+	}
+	mbid := claimed(c)
+	if err := c.HandleOpen(msg.Open{Mailbox: mbid}); err != nil {
+		t.Fatal(err)
+	}
+
+	//Pretend the relay went down a while ago
+	if _, err := db.Get().Exec(`UPDATE mailboxes SET updated=0`); err != nil {
+		t.Fatal(err)
+	}
+	service.Apps = make(map[string]Application)
+
+	if err := reconcile(); err != nil {
+		t.Fatal(err)
+	}
+
+	var opened int
+	db.Get().QueryRow(`SELECT COUNT(*) FROM mailbox_sides WHERE opened=true`).Scan(&opened)
+	if opened != 0 {
+		t.Errorf("expected orphaned sides to be marked as not opened, found %d", opened)
+	}
+
+	var updated int64
+	db.Get().QueryRow(`SELECT updated FROM mailboxes WHERE id=$1`, mbid).Scan(&updated)
+	if updated < time.Now().Add(-time.Minute).Unix() {
+		t.Error("expected the mailbox activity to be reset")
+	}
+
+	//The side comes back and picks up where it left off
+	back := newTestClient(t, "side1")
+	if err := back.HandleClaim(msg.Claim{Nameplate: "3"}); err != nil {
+		t.Fatal(err)
+	} else if claimed(back) != mbid {
+		t.Error("returning side was given a different mailbox")
+	}
+
+	db.Get().QueryRow(`SELECT COUNT(*) FROM mailbox_sides WHERE opened=true`).Scan(&opened)
+	if opened != 1 {
+		t.Errorf("expected the returning side to be opened again, found %d", opened)
+	}
+}
@@ -3,13 +3,16 @@ package relay
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
+	"os"
 	"sync"
 	"time"
 
 	"github.com/chris-pikul/go-wormhole-server/config"
 	"github.com/chris-pikul/go-wormhole-server/db"
 	"github.com/chris-pikul/go-wormhole-server/log"
+	"github.com/chris-pikul/go-wormhole-server/remote"
 )
 
 var (
@@ -22,6 +25,8 @@ var (
 
 	register   chan *Client
 	unregister chan *Client
+
+	trustedProxies remote.Networks
 )
 
 //Initialize sets-up the relay servers initial systems
@@ -32,12 +37,43 @@ func Initialize() error {
 
 	var err error
 
+	trustedProxies, err = remote.ParseNetworks(config.Opts.Relay.TrustedProxies)
+	if err != nil {
+		return err
+	}
+
 	//Spin up the service, without it we should fail
 	service, err = NewService()
 	if err != nil {
 		return err //Pass it up to the CLI
 	}
 
+	//Join the other relays serving the same mailboxes
+	if config.Opts.Relay.Cluster.Bus == config.BusStorage {
+		if err = attachStorageBus(); err != nil {
+			log.Err("failed to attach relay to the storage bus", err)
+			return err
+		}
+	}
+
+	//Nobody is connected yet, whatever the last run left open is orphaned.
+	//Unless other relays share the database, and their clients are still there
+	if db.Shared() || service.Bus != nil {
+		log.Info("database is shared with other relays, leaving its state as is")
+	} else if err = reconcile(); err != nil {
+		log.Err("failed to reconcile relay state from the last run", err)
+		return err
+	}
+
+	//Load the maintenance settings, these can be changed at runtime
+	SetMaintenance(config.Opts.Relay.Maintenance)
+
+	//Same goes for the access lists
+	err = SetAccessLists(config.Opts.Relay.AllowNetworks, config.Opts.Relay.DenyNetworks)
+	if err != nil {
+		return err
+	}
+
 	//Prepare the connection infrastructure
 	clients = make(map[*Client]struct{})
 
@@ -45,6 +81,7 @@ func Initialize() error {
 	unregister = make(chan *Client)
 
 	//Setup router
+	loadIndex()
 	router = http.NewServeMux()
 	router.HandleFunc("/", handleIndex)
 	router.HandleFunc("/v1", handleWebsocket)
@@ -69,25 +106,78 @@ func Shutdown(ctx context.Context) error {
 		log.Info("shutdown relay server")
 	}
 
+	if adminErr := shutdownAdmin(ctx); err == nil {
+		err = adminErr
+	}
+
+	if service != nil && service.Bus != nil {
+		service.Bus.Close()
+	}
+
 	db.Close()
 
 	log.Info("completed shutdown")
 	return err
 }
 
+//attachStorageBus joins the service to the relays
+//polling the database for mailbox events
+func attachStorageBus() error {
+	opts := config.Opts.Relay.Cluster
+
+	node := opts.Node
+	if node == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		node = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+
+	interval := opts.PollInterval
+	if interval == 0 {
+		interval = config.DefaultOptions.Relay.Cluster.PollInterval
+	}
+
+	bus, err := NewStorageBus(time.Millisecond * time.Duration(interval))
+	if err != nil {
+		return err
+	}
+
+	service.Attach(node, bus)
+	log.Infof("relay joined the storage bus as node %s", node)
+	return nil
+}
+
 //Start spins up the relay server as a coroutine
-func Start() {
+func Start() error {
 	if server == nil {
 		panic("attempted to start relay server that has not been initialized")
 	}
 
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return err
+	}
+
+	//The admin API only runs if it is configured
+	if err := startAdmin(); err != nil {
+		listener.Close()
+		return err
+	}
+
+	if config.Opts.Relay.ProxyProtocol {
+		log.Info("relay server expecting PROXY protocol headers")
+		listener = remote.NewListener(listener, trustedProxies)
+	}
+
 	//Handle all the incoming/outgoing connections that get passed in from websocket.
 	//So we run this async so it doesn't block the actual relay server
 	go runRelay()
 
 	go func() {
 		log.Info("starting relay server")
-		err := server.ListenAndServe()
+		err := server.Serve(listener)
 		if err != nil && err != http.ErrServerClosed {
 			log.Err("closing relay server encountered an error", err)
 		}
@@ -96,6 +186,8 @@ func Start() {
 
 	//Allow the cleaning process to run
 	go runCleaning()
+
+	return nil
 }
 
 //CleanNowPure runs the cleaning operation without actually spinning up the
@@ -112,7 +204,7 @@ func CleanNowPure() error {
 		return err //Pass it up to the CLI
 	}
 
-	err = service.CleanApps(time.Now().Unix())
+	_, err = service.CleanApps(time.Now().Unix())
 	if err != nil {
 		return err
 	}
@@ -140,6 +232,7 @@ func runRelay() {
 			if _, ok := clients[clnt]; ok {
 				clnt.Close()
 				delete(clients, clnt)
+				logUsage(clnt, log.UsageDisconnect, "", time.Since(clnt.connected))
 			}
 			LogInfo(clnt, "client unregistered")
 			lockClients.Unlock()
@@ -163,11 +256,12 @@ func runCleaning() {
 	lastCleaning := time.Now().Add(-dur) //simulate the time to be before now so we don't over clean the first time
 	for t := range ticker.C {
 		if service != nil {
-			err := service.CleanApps(lastCleaning.Unix())
+			_, err := service.CleanExpiredApps(lastCleaning.Unix())
 			if err != nil {
 				log.Err("failed to clean relay server", err)
 			}
 		}
+		pruneActivity()
 
 		lastCleaning = t
 	}
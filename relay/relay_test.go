@@ -0,0 +1,135 @@
+package relay
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chris-pikul/go-wormhole-server/config"
+	"github.com/chris-pikul/go-wormhole-server/db"
+	"github.com/chris-pikul/go-wormhole/msg"
+)
+
+const testAppID = "lothar.com/wormhole/text-or-file-xfer"
+
+//postgresDSN is a throwaway PostgreSQL database to run the relay
+//tests against instead of SQLite. Its tables are dropped between tests
+var postgresDSN = os.Getenv("WORMHOLE_TEST_POSTGRES")
+
+//setupRelay starts the relay service on a fresh database
+//and returns the function to tear it down again
+func setupRelay(tb testing.TB) func() {
+	dir, err := ioutil.TempDir("", "wormhole-relay")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	opts := config.DefaultOptions
+	opts.Relay.DBFile = filepath.Join(dir, "relay.db")
+	opts.Relay.PostgresDSN = postgresDSN
+	config.Opts = &opts
+
+	if postgresDSN != "" {
+		resetPostgres(tb)
+	}
+
+	service, err = NewService()
+	if err != nil {
+		os.RemoveAll(dir)
+		tb.Fatal(err)
+	}
+
+	return func() {
+		db.Close()
+		service = nil
+		os.RemoveAll(dir)
+
+		if postgresDSN != "" {
+			resetPostgres(tb)
+		}
+	}
+}
+
+//resetPostgres drops the relay tables from the test database
+func resetPostgres(tb testing.TB) {
+	conn, err := sql.Open("postgres", postgresDSN)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Exec(`DROP TABLE IF EXISTS nameplate_sides, nameplates, messages, mailbox_sides, mailboxes, mailbox_events, version CASCADE`)
+	if err != nil {
+		tb.Fatal(err)
+	}
+}
+
+//newTestClient returns a client bound to the test app with the side,
+//as if it had just connected
+func newTestClient(t *testing.T, side string) *Client {
+	c := &Client{
+		sendBuffer: make(chan msg.IMessage, 64),
+	}
+
+	if err := c.HandleBind(msg.Bind{AppID: testAppID, Side: side}); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+//claimed returns the mailbox ID from the last claimed
+//message sent to the client
+func claimed(c *Client) string {
+	mbid := ""
+	for len(c.sendBuffer) > 0 {
+		if m, ok := (<-c.sendBuffer).(msg.Claimed); ok {
+			mbid = m.Mailbox
+		}
+	}
+	return mbid
+}
+
+func TestCleanNowPure(t *testing.T) {
+	defer setupRelay(t)()
+
+	c := newTestClient(t, "side1")
+	if err := c.HandleClaim(msg.Claim{Nameplate: "6"}); err != nil {
+		t.Fatal(err)
+	}
+	mbid := claimed(c)
+
+	//A minute old, well within the policy's expiration
+	config.Opts.Relay.Apps = map[string]config.AppPolicy{
+		testAppID: {ChannelExpiration: 10},
+	}
+	_, err := db.Get().Exec(`UPDATE mailboxes SET updated=$1 WHERE id=$2`, time.Now().Add(-time.Minute).Unix(), mbid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//The periodic cleaning keeps it for the policy
+	if counts, err := service.CleanExpiredApps(time.Now().Unix()); err != nil {
+		t.Fatal(err)
+	} else if counts.Mailboxes != 0 {
+		t.Error("periodic cleaning ignored the app's expiration policy")
+	}
+	db.Close()
+
+	//Forcing a clean empties the app anyway
+	if err := CleanNowPure(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	var remaining int
+	if err := db.Get().QueryRow(`SELECT COUNT(*) FROM mailboxes`).Scan(&remaining); err != nil {
+		t.Fatal(err)
+	} else if remaining != 0 {
+		t.Error("forced clean left the mailbox of an app with an expiration policy")
+	}
+}
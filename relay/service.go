@@ -1,6 +1,9 @@
 package relay
 
 import (
+	"sync"
+	"time"
+
 	"github.com/chris-pikul/go-wormhole-server/config"
 	"github.com/chris-pikul/go-wormhole-server/db"
 	"github.com/chris-pikul/go-wormhole-server/log"
@@ -16,6 +19,15 @@ type Service struct {
 	Welcome msg.WelcomeInfo
 
 	Apps map[string]Application
+
+	//Node names this relay on the Bus, if there is one
+	Node string
+
+	//Bus passes mailbox events to the other relays sharing the
+	//database. If nil the relay runs alone
+	Bus Bus
+
+	lockApps sync.Mutex
 }
 
 //NewService initializes the relay service object
@@ -55,22 +67,84 @@ func NewService() (*Service, error) {
 //GetApp finds an application registered with the relay service.
 //If not found, it will create and initialize the object for it
 func (s *Service) GetApp(id string) *Application {
+	s.lockApps.Lock()
+	defer s.lockApps.Unlock()
+
 	app, ok := s.Apps[id]
 	if !ok {
 		//Create new application and bind it
 		log.Infof("creating new application container for %s", id)
 		app, _ = NewApplication(id)
+		app.publish = s.publish
 		s.Apps[id] = app
 	}
 
 	return &app
 }
 
+//findApp returns the application if it is in memory
+func (s *Service) findApp(id string) (Application, bool) {
+	s.lockApps.Lock()
+	defer s.lockApps.Unlock()
+
+	app, ok := s.Apps[id]
+	return app, ok
+}
+
+//Attach joins the service to the bus under the node name,
+//so that clients of the same mailbox can be served by
+//different relays
+func (s *Service) Attach(node string, bus Bus) {
+	s.Node = node
+	s.Bus = bus
+	bus.Subscribe(s.handleEvent)
+}
+
+//publish sends the event to the other relays, if attached to a bus
+func (s *Service) publish(ev MailboxEvent) {
+	if s.Bus == nil {
+		return
+	}
+
+	ev.Node = s.Node
+	if err := s.Bus.Publish(ev); err != nil {
+		log.Err("failed to publish mailbox event", err)
+	}
+}
+
+//handleEvent acts on the events from other relays for
+//the mailboxes this relay has listeners on
+func (s *Service) handleEvent(ev MailboxEvent) {
+	if ev.Node == s.Node {
+		return //Already handled when it happened
+	}
+
+	app, ok := s.findApp(ev.AppID)
+	if !ok {
+		return
+	}
+
+	mbox := app.mailbox(ev.MailboxID)
+	if mbox == nil {
+		return
+	}
+
+	switch ev.Kind {
+	case EventMessage:
+		if err := mbox.catchUp(); err != nil {
+			log.Err("failed to deliver messages from another relay", err)
+		}
+	case EventExpired:
+		mbox.stopAllListeners(ErrMailboxExpired)
+		app.FreeMailbox(ev.MailboxID)
+	}
+}
+
 //GetAllApps returns all the application IDs in memory, and in
 //the database.
 //I will admit, this function was A LOT shorter in the Python
 //version.
-func (s Service) GetAllApps() ([]string, error) {
+func (s *Service) GetAllApps() ([]string, error) {
 	if db.Get() == nil {
 		return []string{}, db.ErrNotOpen
 	}
@@ -78,7 +152,7 @@ func (s Service) GetAllApps() ([]string, error) {
 	apps := make([]string, 0)
 
 	{ //Scope for the defer
-		rows, err := db.Get().Query(`SELECT DISTINCT app_id FROM nameplates`)
+		rows, err := db.Reader().Query(`SELECT DISTINCT app_id FROM nameplates`)
 		if err != nil {
 			return apps, err
 		}
@@ -107,7 +181,7 @@ func (s Service) GetAllApps() ([]string, error) {
 	}
 
 	{ //Scope for the defer
-		rows, err := db.Get().Query(`SELECT DISTINCT app_id FROM mailboxes`)
+		rows, err := db.Reader().Query(`SELECT DISTINCT app_id FROM mailboxes`)
 		if err != nil {
 			return apps, err
 		}
@@ -136,7 +210,7 @@ func (s Service) GetAllApps() ([]string, error) {
 	}
 
 	{ //Scope for the defer
-		rows, err := db.Get().Query(`SELECT DISTINCT app_id FROM messages`)
+		rows, err := db.Reader().Query(`SELECT DISTINCT app_id FROM messages`)
 		if err != nil {
 			return apps, err
 		}
@@ -167,38 +241,66 @@ func (s Service) GetAllApps() ([]string, error) {
 	return apps, nil
 }
 
-//CleanApps iterates the apps registered to the service
-//and runs the cleaining process on each one
-func (s *Service) CleanApps(since int64) error {
+//CleanApps iterates the apps with data in the database, or
+//registered to the service, and runs the cleaining process on each one.
+//Every application is cleaned of channels older than since, whatever
+//its policy says, as when cleaning is forced from the CLI.
+//Returns the total counts of what was removed
+func (s *Service) CleanApps(since int64) (CleanupCounts, error) {
+	return s.cleanApps(since, false)
+}
+
+//CleanExpiredApps is CleanApps for the periodic cleaning. Applications
+//with a channel expiration policy are cleaned of channels older than
+//it, instead of since
+func (s *Service) CleanExpiredApps(since int64) (CleanupCounts, error) {
+	return s.cleanApps(since, true)
+}
+
+func (s *Service) cleanApps(since int64, policies bool) (CleanupCounts, error) {
 	log.Info("cleaning all applications")
 
+	var total CleanupCounts
 	apps, err := s.GetAllApps()
 	if err != nil {
-		return err
+		return total, err
 	}
 
 	deadApps := make([]string, 0)
 	for _, appID := range apps {
-		app, ok := s.Apps[appID]
-		if ok {
-			err := app.Cleanup(since)
-			if err != nil {
-				return err
-			}
+		app, ok := s.findApp(appID)
+		if !ok {
+			//Nobody is connected to it, but it still has data
+			app, _ = NewApplication(appID)
+			app.publish = s.publish
+		}
 
-			if !app.StillInUse() {
-				//OK to clear this one
-				deadApps = append(deadApps, appID)
-			}
+		appSince := since
+		if exp := app.Policy().ChannelExpiration; policies && exp > 0 {
+			appSince = time.Now().Add(-time.Minute * time.Duration(exp)).Unix()
+		}
+
+		counts, err := app.Cleanup(appSince)
+		if err != nil {
+			return total, err
+		}
+		total.Add(counts)
+
+		if ok && !app.StillInUse() {
+			//OK to clear this one
+			deadApps = append(deadApps, appID)
 		}
 	}
 
 	//No longer in use, dump the memory
+	s.lockApps.Lock()
 	for _, appID := range deadApps {
 		log.Infof("removed dead application from memory %s", appID)
 		delete(s.Apps, appID)
 	}
+	s.lockApps.Unlock()
 
-	log.Info("completed cleaning")
-	return nil
+	log.Infof("completed cleaning, removed %d mailboxes, %d messages and %d nameplates",
+		total.Mailboxes, total.Messages, total.Nameplates)
+	return total, nil
 }
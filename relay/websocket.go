@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/chris-pikul/go-wormhole-server/log"
+	"github.com/chris-pikul/go-wormhole-server/remote"
 	"github.com/chris-pikul/go-wormhole/msg"
 	"github.com/gorilla/websocket"
 )
@@ -28,6 +29,9 @@ func initWebsocket() error {
 func handleWebsocket(w http.ResponseWriter, r *http.Request) {
 	respHeader := http.Header{}
 
+	addr := remote.RequestIP(r, trustedProxies)
+	allowed := AddressAllowed(addr)
+
 	conn, err := upgrader.Upgrade(w, r, respHeader)
 	if err != nil {
 		log.Warnf("upgrading connection to websocket failed: %s", err.Error())
@@ -37,9 +41,47 @@ func handleWebsocket(w http.ResponseWriter, r *http.Request) {
 	client := &Client{
 		conn:       conn,
 		sendBuffer: make(chan msg.IMessage, 64),
+		remoteAddr: addr,
+		hangup:     make(chan struct{}, 1),
+		connected:  time.Now(),
+	}
+
+	if !allowed {
+		LogInfo(client, "refusing client from denied network")
+		refuseClient(conn, AccessDeniedMessage)
+		return
+	}
+
+	//Credentials given on the upgrade are checked straight away,
+	//otherwise they are expected in the bind message
+	if token := requestToken(r); token != "" && authRequired() {
+		client.credential = findCredential(token)
+		if client.credential == nil {
+			LogInfo(client, "refusing client with invalid credentials")
+			refuseClient(conn, AuthInvalidMessage)
+			return
+		}
 	}
+
 	register <- client
 
 	go client.watchWrites()
 	go client.watchReads()
 }
+
+//refuseClient sends the welcome message carrying the reason as an error,
+//so that clients can display it, and then closes the connection.
+//Used for clients that are not allowed to be registered
+func refuseClient(conn *websocket.Conn, reason string) {
+	info := service.Welcome
+	info.Error = &reason
+
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	conn.WriteJSON(msg.Welcome{
+		Message: msg.NewServerMessage(msg.TypeWelcome),
+
+		Info: info,
+	})
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, ""))
+	conn.Close()
+}
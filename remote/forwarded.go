@@ -0,0 +1,70 @@
+package remote
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+//RequestIP returns the real client IP address for an HTTP request.
+//The Forwarded (RFC 7239) and X-Forwarded-For headers are only
+//believed when the request comes from one of the trusted proxies.
+//The chain of addresses is walked from the closest hop outward,
+//and the first address that is not a trusted proxy is the client
+func RequestIP(r *http.Request, trusted Networks) net.IP {
+	peer := ParseHostIP(r.RemoteAddr)
+	if len(trusted) == 0 || !trusted.Contains(peer) {
+		return peer
+	}
+
+	chain := forwardedFor(r.Header)
+	if len(chain) == 0 {
+		chain = xForwardedFor(r.Header)
+	}
+
+	client := peer
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := ParseHostIP(chain[i])
+		if ip == nil {
+			break //Garbage in the chain, don't trust anything past it
+		}
+
+		client = ip
+		if !trusted.Contains(ip) {
+			break
+		}
+	}
+
+	return client
+}
+
+//xForwardedFor returns the addresses in the X-Forwarded-For headers
+func xForwardedFor(h http.Header) []string {
+	res := make([]string, 0)
+	for _, line := range h["X-Forwarded-For"] {
+		for _, entry := range strings.Split(line, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				res = append(res, entry)
+			}
+		}
+	}
+	return res
+}
+
+//forwardedFor returns the "for" addresses in the Forwarded headers
+func forwardedFor(h http.Header) []string {
+	res := make([]string, 0)
+	for _, line := range h["Forwarded"] {
+		for _, element := range strings.Split(line, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) != 2 || !strings.EqualFold(kv[0], "for") {
+					continue
+				}
+
+				res = append(res, strings.Trim(kv[1], "\""))
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,97 @@
+package remote
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRequestIP(t *testing.T) {
+	trusted, err := ParseNetworks([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		trusted Networks
+		ip      string
+	}{
+		{
+			name:   "no headers",
+			remote: "203.0.113.7:5555",
+			ip:     "203.0.113.7",
+		},
+		{
+			name:    "untrusted peer is not believed",
+			remote:  "203.0.113.7:5555",
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			trusted: trusted,
+			ip:      "203.0.113.7",
+		},
+		{
+			name:    "no trusted proxies ignores headers",
+			remote:  "10.0.0.5:5555",
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			ip:      "10.0.0.5",
+		},
+		{
+			name:    "trusted x-forwarded-for",
+			remote:  "10.0.0.5:5555",
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			trusted: trusted,
+			ip:      "198.51.100.1",
+		},
+		{
+			name:    "spoofed entries before the real client are skipped",
+			remote:  "10.0.0.5:5555",
+			headers: map[string]string{"X-Forwarded-For": "1.1.1.1, 198.51.100.1, 10.0.0.9"},
+			trusted: trusted,
+			ip:      "198.51.100.1",
+		},
+		{
+			name:    "forwarded header",
+			remote:  "192.168.1.1:5555",
+			headers: map[string]string{"Forwarded": `for=192.0.2.60;proto=http;by=203.0.113.43`},
+			trusted: trusted,
+			ip:      "192.0.2.60",
+		},
+		{
+			name:    "forwarded header with ipv6",
+			remote:  "10.0.0.5:5555",
+			headers: map[string]string{"Forwarded": `for="[2001:db8:cafe::17]:4711", for=10.0.0.6`},
+			trusted: trusted,
+			ip:      "2001:db8:cafe::17",
+		},
+		{
+			name:    "forwarded is preferred",
+			remote:  "10.0.0.5:5555",
+			headers: map[string]string{"Forwarded": "for=192.0.2.60", "X-Forwarded-For": "198.51.100.1"},
+			trusted: trusted,
+			ip:      "192.0.2.60",
+		},
+		{
+			name:    "garbage stops the walk",
+			remote:  "10.0.0.5:5555",
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.1, unknown"},
+			trusted: trusted,
+			ip:      "10.0.0.5",
+		},
+	}
+
+	for _, tc := range tests {
+		r := &http.Request{
+			RemoteAddr: tc.remote,
+			Header:     http.Header{},
+		}
+		for k, v := range tc.headers {
+			r.Header.Set(k, v)
+		}
+
+		ip := RequestIP(r, tc.trusted)
+		if ip.String() != tc.ip {
+			t.Errorf("%s: expected %s got %s", tc.name, tc.ip, ip)
+		}
+	}
+}
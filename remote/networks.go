@@ -0,0 +1,130 @@
+package remote
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+//Networks is a list of IP networks used for matching
+//client addresses against
+type Networks []*net.IPNet
+
+//ParseNetworks converts a list of CIDR notation strings into
+//Networks. Plain IP addresses are accepted as single host networks.
+//Returns an error naming the first entry that could not be parsed
+func ParseNetworks(list []string) (Networks, error) {
+	nets := make(Networks, 0, len(list))
+
+	for _, entry := range list {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nets, fmt.Errorf("invalid network address '%s'", entry)
+			}
+
+			if ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+
+		_, ipnet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nets, fmt.Errorf("invalid network address '%s'", entry)
+		}
+		nets = append(nets, ipnet)
+	}
+
+	return nets, nil
+}
+
+//Contains returns true if the IP falls within any of the networks
+func (n Networks) Contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, ipnet := range n {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//HostIP returns the IP portion of a network address,
+//or nil if it does not contain one
+func HostIP(addr net.Addr) net.IP {
+	if addr == nil {
+		return nil
+	}
+
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	}
+
+	return ParseHostIP(addr.String())
+}
+
+//ParseHostIP returns the IP from a "host:port" or plain IP string,
+//or nil if it does not contain one
+func ParseHostIP(hostport string) net.IP {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	return net.ParseIP(strings.Trim(host, "[]"))
+}
+
+//Filter decides which addresses are allowed to connect based
+//on allow and deny lists of networks
+type Filter struct {
+	//Allow holds the only networks that may connect.
+	//If empty, all networks are allowed
+	Allow Networks
+
+	//Deny holds networks that may never connect,
+	//this takes priority over Allow
+	Deny Networks
+}
+
+//NewFilter parses the allow and deny lists of CIDR
+//notation strings into a Filter
+func NewFilter(allow, deny []string) (*Filter, error) {
+	allowNets, err := ParseNetworks(allow)
+	if err != nil {
+		return nil, err
+	}
+
+	denyNets, err := ParseNetworks(deny)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Filter{
+		Allow: allowNets,
+		Deny:  denyNets,
+	}, nil
+}
+
+//Allowed returns true if the IP passes the filter.
+//A nil filter allows everything
+func (f *Filter) Allowed(ip net.IP) bool {
+	if f == nil {
+		return true
+	}
+
+	if f.Deny.Contains(ip) {
+		return false
+	}
+
+	return len(f.Allow) == 0 || f.Allow.Contains(ip)
+}
@@ -0,0 +1,62 @@
+package remote
+
+import (
+	"testing"
+)
+
+func TestParseNetworks(t *testing.T) {
+	nets, err := ParseNetworks([]string{"10.0.0.0/8", "2001:db8::/32", "192.168.1.1", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(nets) != 4 {
+		t.Errorf("expected 4 networks, got %d", len(nets))
+	}
+
+	if !nets.Contains(ParseHostIP("10.1.2.3")) || !nets.Contains(ParseHostIP("::1")) {
+		t.Error("expected addresses to be contained")
+	} else if nets.Contains(ParseHostIP("192.168.1.2")) {
+		t.Error("single address networks should not match neighbours")
+	}
+
+	if _, err := ParseNetworks([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("expected bad network to fail")
+	}
+	if _, err := ParseNetworks([]string{"not-an-ip"}); err == nil {
+		t.Error("expected bad address to fail")
+	}
+}
+
+func TestFilter(t *testing.T) {
+	var open *Filter
+	if !open.Allowed(ParseHostIP("203.0.113.7")) {
+		t.Error("nil filter should allow everything")
+	}
+
+	deny, err := NewFilter(nil, []string{"203.0.113.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deny.Allowed(ParseHostIP("203.0.113.7")) {
+		t.Error("denied address was allowed")
+	} else if !deny.Allowed(ParseHostIP("198.51.100.1")) {
+		t.Error("address not in the deny list was refused")
+	}
+
+	private, err := NewFilter([]string{"10.0.0.0/8"}, []string{"10.0.0.13"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !private.Allowed(ParseHostIP("10.1.2.3")) {
+		t.Error("allowed address was refused")
+	} else if private.Allowed(ParseHostIP("198.51.100.1")) {
+		t.Error("address outside the allow list was allowed")
+	} else if private.Allowed(ParseHostIP("10.0.0.13")) {
+		t.Error("deny should take priority over allow")
+	}
+
+	if _, err := NewFilter([]string{"bad"}, nil); err == nil {
+		t.Error("expected bad allow list to fail")
+	}
+}
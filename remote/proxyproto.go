@@ -0,0 +1,225 @@
+package remote
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//HeaderTimeout is how long a connection has to deliver
+//its PROXY protocol header
+var HeaderTimeout = 10 * time.Second
+
+var (
+	//ErrProxyHeader is returned when a PROXY protocol header
+	//could not be understood
+	ErrProxyHeader = errors.New("invalid PROXY protocol header")
+
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const proxyV1MaxLength = 107
+
+//Listener wraps a net.Listener and reads the PROXY protocol
+//(version 1 or 2) header from connections that come from
+//trusted proxies, so that RemoteAddr reports the real client
+type Listener struct {
+	net.Listener
+
+	//Trusted holds the networks allowed to send PROXY headers.
+	//If empty, every peer is trusted
+	Trusted Networks
+}
+
+//NewListener wraps the listener for PROXY protocol handling
+func NewListener(ln net.Listener, trusted Networks) *Listener {
+	return &Listener{
+		Listener: ln,
+		Trusted:  trusted,
+	}
+}
+
+//Accept waits for the next connection. The PROXY header is not
+//read here, but lazily on the first Read or RemoteAddr, so that
+//slow clients do not hold up the accept loop
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return c, err
+	}
+
+	if len(l.Trusted) > 0 && !l.Trusted.Contains(HostIP(c.RemoteAddr())) {
+		//Untrusted peers are taken as-is
+		return c, nil
+	}
+
+	return &Conn{
+		Conn:   c,
+		reader: bufio.NewReader(c),
+	}, nil
+}
+
+//Conn is a connection that starts with a PROXY protocol header
+type Conn struct {
+	net.Conn
+
+	reader *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+//Read reads from the connection after the PROXY header
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+//RemoteAddr returns the client address provided by the PROXY
+//header, or the connection address if there was none
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(HeaderTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	c.remote, c.err = ReadProxyHeader(c.reader)
+}
+
+//ReadProxyHeader reads a version 1 or 2 PROXY protocol header
+//from the reader. Returns the source address, which is nil when
+//the header does not carry one (UNKNOWN or LOCAL)
+func ReadProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(sig, proxyV1Prefix) {
+		return readProxyV1(r)
+	}
+
+	sig, err = r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+
+	return nil, ErrProxyHeader
+}
+
+//readProxyV1 parses the human readable header
+//	PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	line := make([]byte, 0, proxyV1MaxLength)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+
+		if b == '\n' {
+			break
+		} else if len(line) >= proxyV1MaxLength {
+			return nil, ErrProxyHeader
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrProxyHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 {
+		return nil, ErrProxyHeader
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+		if len(fields) != 6 {
+			return nil, ErrProxyHeader
+		}
+
+		ip := net.ParseIP(fields[2])
+		port, err := strconv.Atoi(fields[4])
+		if ip == nil || err != nil || port < 0 || port > 65535 {
+			return nil, ErrProxyHeader
+		}
+		return &net.TCPAddr{IP: ip, Port: port}, nil
+	}
+
+	return nil, ErrProxyHeader
+}
+
+//readProxyV2 parses the binary header
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	verCmd := header[12]
+	family := header[13]
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+
+	if verCmd>>4 != 2 {
+		return nil, ErrProxyHeader
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	if verCmd&0x0F == 0 {
+		//LOCAL command, such as health checks from the proxy itself
+		return nil, nil
+	} else if verCmd&0x0F != 1 {
+		return nil, ErrProxyHeader
+	}
+
+	switch family >> 4 {
+	case 1: //IPv4
+		if length < 12 {
+			return nil, ErrProxyHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:10])),
+		}, nil
+	case 2: //IPv6
+		if length < 36 {
+			return nil, ErrProxyHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:34])),
+		}, nil
+	}
+
+	//Unix sockets, or unspecified, carry nothing useful
+	return nil, nil
+}
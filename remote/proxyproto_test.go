@@ -0,0 +1,170 @@
+package remote
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestProxyV1(t *testing.T) {
+	tests := []struct {
+		header string
+		addr   string
+		err    bool
+	}{
+		{"PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n", "192.168.0.1:56324", false},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 4711 443\r\n", "[2001:db8::1]:4711", false},
+		{"PROXY UNKNOWN\r\n", "", false},
+		{"PROXY TCP4 192.168.0.1 192.168.0.11 56324\r\n", "", true},
+		{"PROXY TCP4 not-an-ip 192.168.0.11 56324 443\r\n", "", true},
+		{"PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\n", "", true},
+		{"PROXY " + strings.Repeat("A", 200) + "\r\n", "", true},
+		{"GET / HTTP/1.1\r\n", "", true},
+	}
+
+	for _, tc := range tests {
+		r := bufio.NewReader(strings.NewReader(tc.header + "payload"))
+		addr, err := ReadProxyHeader(r)
+		if tc.err {
+			if err == nil {
+				t.Errorf("expected an error for %q", tc.header)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("unexpected error for %q: %s", tc.header, err)
+			continue
+		}
+
+		if tc.addr == "" && addr != nil {
+			t.Errorf("expected no address for %q, got %s", tc.header, addr)
+		} else if tc.addr != "" && (addr == nil || addr.String() != tc.addr) {
+			t.Errorf("expected %s for %q, got %v", tc.addr, tc.header, addr)
+		}
+
+		rest, _ := ioutil.ReadAll(r)
+		if string(rest) != "payload" {
+			t.Errorf("header %q consumed too much, left %q", tc.header, rest)
+		}
+	}
+}
+
+func proxyV2Header(cmd, family byte, payload []byte) []byte {
+	buf := bytes.NewBuffer(nil)
+	buf.Write(proxyV2Signature)
+	buf.WriteByte(0x20 | cmd)
+	buf.WriteByte(family)
+	binary.Write(buf, binary.BigEndian, uint16(len(payload)))
+	buf.Write(payload)
+	return buf.Bytes()
+}
+
+func TestProxyV2(t *testing.T) {
+	ipv4 := []byte{10, 0, 0, 1, 10, 0, 0, 2, 0x1F, 0x90, 0x01, 0xBB}
+	ipv6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0x1F, 0x90, 0x01, 0xBB)
+
+	tests := []struct {
+		header []byte
+		addr   string
+		err    bool
+	}{
+		{proxyV2Header(1, 0x11, ipv4), "10.0.0.1:8080", false},
+		{proxyV2Header(1, 0x21, ipv6), "[2001:db8::1]:8080", false},
+		{proxyV2Header(0, 0x00, nil), "", false},
+		{proxyV2Header(1, 0x11, ipv4[:6]), "", true},
+		{proxyV2Header(5, 0x11, ipv4), "", true},
+	}
+
+	for i, tc := range tests {
+		r := bufio.NewReader(bytes.NewReader(append(tc.header, []byte("payload")...)))
+		addr, err := ReadProxyHeader(r)
+		if tc.err {
+			if err == nil {
+				t.Errorf("case %d expected an error", i)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("case %d unexpected error: %s", i, err)
+			continue
+		}
+
+		if tc.addr == "" && addr != nil {
+			t.Errorf("case %d expected no address, got %s", i, addr)
+		} else if tc.addr != "" && (addr == nil || addr.String() != tc.addr) {
+			t.Errorf("case %d expected %s, got %v", i, tc.addr, addr)
+		}
+
+		rest, _ := ioutil.ReadAll(r)
+		if string(rest) != "payload" {
+			t.Errorf("case %d consumed too much, left %q", i, rest)
+		}
+	}
+}
+
+func TestListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	trusted, _ := ParseNetworks([]string{"127.0.0.0/8"})
+	proxied := NewListener(ln, trusted)
+
+	go func() {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		c.Write([]byte("PROXY TCP4 203.0.113.7 127.0.0.1 5555 4001\r\nhello"))
+		c.Close()
+	}()
+
+	c, err := proxied.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if c.RemoteAddr().String() != "203.0.113.7:5555" {
+		t.Errorf("expected the proxied address, got %s", c.RemoteAddr())
+	}
+
+	data, _ := ioutil.ReadAll(c)
+	if string(data) != "hello" {
+		t.Errorf("expected the payload after the header, got %q", data)
+	}
+}
+
+func TestListenerUntrusted(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	trusted, _ := ParseNetworks([]string{"10.0.0.0/8"})
+	proxied := NewListener(ln, trusted)
+
+	go func() {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		c.Write([]byte("PROXY TCP4 203.0.113.7 127.0.0.1 5555 4001\r\n"))
+		c.Close()
+	}()
+
+	c, err := proxied.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if HostIP(c.RemoteAddr()).String() != "127.0.0.1" {
+		t.Errorf("untrusted peers should not be able to spoof, got %s", c.RemoteAddr())
+	}
+}
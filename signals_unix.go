@@ -0,0 +1,19 @@
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+var (
+	//sigReload asks the server to re-read the configuration file
+	sigReload os.Signal = syscall.SIGHUP
+
+	//sigMaintenance toggles the relay maintenance mode
+	sigMaintenance os.Signal = syscall.SIGUSR2
+
+	//sigReopen reopens the log files after external log rotation
+	sigReopen os.Signal = syscall.SIGUSR1
+)
@@ -0,0 +1,21 @@
+// +build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+var (
+	//sigReload asks the server to re-read the configuration file
+	sigReload os.Signal = syscall.SIGHUP
+
+	//sigMaintenance is not available on windows, use the
+	//configuration file and sigReload instead
+	sigMaintenance os.Signal
+
+	//sigReopen is not available on windows, log files
+	//can only be rotated by the relay itself
+	sigReopen os.Signal
+)
@@ -0,0 +1,39 @@
+package transit
+
+import (
+	"net"
+	"sync"
+
+	"github.com/chris-pikul/go-wormhole-server/log"
+	"github.com/chris-pikul/go-wormhole-server/remote"
+)
+
+var (
+	accessFilter     *remote.Filter
+	lockAccessFilter sync.RWMutex
+)
+
+//SetAccessLists replaces the allow and deny lists of networks
+//that may use the transit. This can be called while running to
+//reload the lists
+func SetAccessLists(allow, deny []string) error {
+	filter, err := remote.NewFilter(allow, deny)
+	if err != nil {
+		return err
+	}
+
+	lockAccessFilter.Lock()
+	accessFilter = filter
+	lockAccessFilter.Unlock()
+
+	log.Infof("transit access lists updated with %d allowed and %d denied networks", len(filter.Allow), len(filter.Deny))
+	return nil
+}
+
+//AddressAllowed returns true if the IP address may use the transit
+func AddressAllowed(ip net.IP) bool {
+	lockAccessFilter.RLock()
+	defer lockAccessFilter.RUnlock()
+
+	return accessFilter.Allowed(ip)
+}
@@ -0,0 +1,51 @@
+package transit
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDeniedConnections(t *testing.T) {
+	if err := SetAccessLists(nil, []string{"127.0.0.0/8"}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetAccessLists(nil, nil)
+
+	server, client := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		handleConnection(&pipeConn{server})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("denied tcp connection was not closed")
+	}
+	client.Close()
+
+	ws := httptest.NewServer(http.HandlerFunc(handleWebsocket))
+	defer ws.Close()
+
+	resp, err := http.Get(ws.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected denied websocket to be forbidden, got %d", resp.StatusCode)
+	}
+}
+
+//pipeConn gives a net.Pipe connection a loopback address
+type pipeConn struct {
+	net.Conn
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+}
@@ -3,13 +3,21 @@ package transit
 import (
 	"bufio"
 	"errors"
+	"io"
 	"net"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/chris-pikul/go-wormhole-server/log"
+	"github.com/chris-pikul/go-wormhole-server/remote"
 )
 
+//pipeBufferSize is the chunk size used when piping data
+//between paired clients
+const pipeBufferSize = 4096
+
 //Client wraps up the net.Conn connection
 //with other local properties describing
 //a client connection to the transit
@@ -25,6 +33,13 @@ type Client struct {
 	Mood     string
 
 	Buddy *Client
+
+	session     *session
+	addrLimiter *rateLimiter
+
+	piping    bool
+	closeLock sync.Mutex
+	closed    bool
 }
 
 //NewClient returns a new client object pointer
@@ -32,18 +47,34 @@ func NewClient(con net.Conn) *Client {
 	return &Client{
 		conn:     con,
 		TokenBuf: make([]byte, 0),
+		Mood:     MoodErrory,
 	}
 }
 
 //Close shutsdown the client connection and
 //frees any resources we may be consuming
 func (c *Client) Close() {
+	c.closeLock.Lock()
+	if c.closed {
+		c.closeLock.Unlock()
+		return
+	}
+	c.closed = true
+	c.closeLock.Unlock()
+
+	//Make sure nobody can pair with us anymore
+	c.removePending()
+
+	if c.session != nil {
+		releaseAddressLimiter(c.conn.RemoteAddr())
+	}
+
 	if c.conn != nil {
+		log.Infof("closing transit connection %s with mood %s", c.conn.RemoteAddr().String(), c.mood())
 		c.conn.Close()
-		c.conn = nil
 	}
 
-	if c.Buddy != nil && c.Buddy.conn != nil {
+	if c.Buddy != nil {
 		c.Buddy.Close()
 	}
 }
@@ -51,28 +82,79 @@ func (c *Client) Close() {
 //HandleConnection takes over the client connection and starts
 //processing data that comes in from it
 func (c *Client) HandleConnection() {
+	c.setDeadline(handshakeTimeout)
+
+	reader := bufio.NewReader(c.conn)
+	buf := make([]byte, pipeBufferSize)
 	for {
-		data, err := bufio.NewReader(c.conn).ReadBytes('\n')
-		if err != nil {
-			if strings.Contains(err.Error(), "closed by the remote host") {
-				//Ok closed by remote
-				log.Info("connection closed by remote client")
+		var data []byte
+		var err error
+		if c.GotToken {
+			//Past the handshake, everything is raw bytes
+			var n int
+			n, err = reader.Read(buf)
+			data = buf[:n]
+		} else {
+			//Handshakes are a single line, and are limited
+			//by the size of the reader buffer
+			data, err = reader.ReadSlice('\n')
+			if err == bufio.ErrBufferFull {
+				c.conn.Write([]byte("bad handshake\n"))
+				log.Info("transit handshake was too long")
 				return
 			}
+		}
 
-			log.Err("failed to read from client", err)
-			return
+		//Partial handshake lines are dropped with the error
+		if len(data) > 0 && (err == nil || c.GotToken) {
+			if err := c.handleData(data); err != nil {
+				log.Err("failed to handle client message", err)
+				return
+			}
 		}
 
-		if err := c.handleData(data); err != nil {
-			log.Err("failed to handle client message", err)
+		if err != nil {
+			c.handleReadError(err)
 			return
 		}
 	}
 }
 
+//handleReadError records the mood for a connection that has
+//stopped being readable, because of timeout or disconnect
+func (c *Client) handleReadError(err error) {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		if c.GotToken {
+			log.Info("transit client timed out waiting for a partner")
+		} else {
+			log.Info("transit client timed out during handshake")
+		}
+		return
+	}
+
+	if err == io.EOF || strings.Contains(err.Error(), "closed by the remote host") {
+		//Ok closed by remote
+		log.Info("connection closed by remote client")
+		return
+	}
+
+	if c.isClosed() {
+		return //We closed it ourselves, likely from our buddy leaving
+	}
+
+	log.Err("failed to read from client", err)
+}
+
 func (c *Client) handleData(data []byte) error {
-	if c.SentOK {
+	if c.piping || c.isPaired() {
+		c.piping = true
+
+		//Both clients share the session, so the buddy is
+		//recorded as capped too without touching its mood
+		if err := c.throttle(len(data)); err != nil {
+			return err
+		}
+
 		//Connection was established, so start
 		//pumping data back to the other client
 		if c.Buddy != nil && c.Buddy.conn != nil {
@@ -82,7 +164,8 @@ func (c *Client) handleData(data []byte) error {
 		}
 		return nil
 	} else if c.GotToken {
-		c.conn.Write([]byte("impatient"))
+		c.Mood = MoodErrory
+		c.conn.Write([]byte("impatient\n"))
 		return errors.New("transit impatience failure")
 	}
 
@@ -92,15 +175,21 @@ func (c *Client) handleData(data []byte) error {
 	tokenStr := string(c.TokenBuf)
 	if _, has, token := checkOldToken(tokenStr); has {
 		//Old token passes
+		if !handshakeAllowed(remote.HostIP(c.conn.RemoteAddr())) {
+			return c.refuseHandshake()
+		}
 		log.Infof("accepting old version token '%s'", token)
 		c.processToken(token, "")
 	} else if _, has, token, side := checkNewToken(tokenStr); has {
 		//New token passes
+		if !handshakeAllowed(remote.HostIP(c.conn.RemoteAddr())) {
+			return c.refuseHandshake()
+		}
 		log.Infof("accepting new token '%s' for side '%s'", token, side)
 		c.processToken(token, side)
 	} else {
 		//Shortcut this for now
-		c.conn.Write([]byte("bad handshake"))
+		c.conn.Write([]byte("bad handshake\n"))
 		return errors.New("transit handshake failure")
 	}
 
@@ -108,6 +197,14 @@ func (c *Client) handleData(data []byte) error {
 	return nil
 }
 
+//refuseHandshake rejects a valid handshake that did not pass
+//the handshake check, the same as a malformed one
+func (c *Client) refuseHandshake() error {
+	log.Infof("refusing transit handshake not known to the relay: %s", c.conn.RemoteAddr().String())
+	c.conn.Write([]byte("bad handshake\n"))
+	return errors.New("transit handshake refused")
+}
+
 var oldTokenLength = len("please relay \n") + (32 * 2)
 var oldTokenMatcher = regexp.MustCompile("^please relay (\\w{64})\n")
 
@@ -150,59 +247,170 @@ func checkNewToken(token string) (int, bool, string, string) {
 func (c *Client) processToken(token, side string) {
 	c.Token = token
 	c.Side = side
-	c.Mood = "lonely"
+	c.Mood = MoodLonely
 	c.GotToken = true
 
+	//Wait for a partner, but not forever
+	c.setDeadline(lonelyTimeout)
+
 	//Populate into the potentials for the service
 	lock.Lock()
 	defer lock.Unlock()
 
-	if potentials, ok := pending[token]; ok { //We have potentials to search
-		log.Debugf("searching %d potential connections for %s", len(potentials), token)
-		var match *transitConn
-		for i, ex := range potentials {
-			if ex.Side == "" || side == "" || ex.Side != side {
-				//We have a match for a transaction
-				match = &potentials[i]
-
-				//Swap and trim the current one
-				potentials[i] = potentials[len(potentials)-1]
-				potentials = potentials[:len(potentials)-1]
-
-				for _, red := range potentials {
-					if red.Client.conn != nil {
-						log.Debugf("clearing out redundent in pending list %s", red.Client.conn.RemoteAddr().String())
-						red.Client.conn.Write([]byte("redundent"))
-					}
-					red.Client.Close()
-				}
-
-				break
-			}
+	potentials := pending[token]
+	log.Debugf("searching %d potential connections for %s", len(potentials), token)
+
+	match := findPartner(potentials, side)
+	if match < 0 {
+		//Nobody to pair with yet, wait in line
+		pending[token] = append(potentials, transitConn{
+			Side:   side,
+			Client: c,
+		})
+		return
+	}
+
+	//The token is used up now, so any other connections still
+	//waiting on it are spares (usually extra connection hints
+	//from one of the sides) and get dropped
+	delete(pending, token)
+	for i, red := range potentials {
+		if i != match {
+			red.Client.disconnectRedundant()
+		}
+	}
+
+	//start connection
+	buddy := potentials[match].Client
+	sess := newSession()
+	buddy.connectWith(c, sess)
+	c.connectWith(buddy, sess)
+}
+
+//findPartner searches the waiting connections, oldest first, for one
+//that can be paired with the provided side.
+//Returns the index of the partner, or -1 if there is none
+func findPartner(potentials []transitConn, side string) int {
+	for i, ex := range potentials {
+		if sidesMatch(ex.Side, side) {
+			return i
 		}
+	}
+	return -1
+}
+
+//sidesMatch returns true if two handshakes with the same token
+//belong to different sides of the transfer. Old style handshakes
+//carry no side, and will match anything
+func sidesMatch(a, b string) bool {
+	return a == "" || b == "" || a != b
+}
+
+//disconnectRedundant closes a waiting client that lost out to another
+//connection for the same token, must be called while holding the pending lock
+func (c *Client) disconnectRedundant() {
+	//Mark it closed first so its own read loop sees the closed
+	//connection as expected rather than as an error
+	c.closeLock.Lock()
+	c.closed = true
+	c.closeLock.Unlock()
+
+	c.Mood = MoodRedundant
+	if c.conn != nil {
+		log.Debugf("clearing out redundant in pending list %s", c.conn.RemoteAddr().String())
+		c.conn.Close()
+	}
+}
+
+//removePending takes the client out of the pending list if
+//it is still waiting there for a partner
+func (c *Client) removePending() {
+	if !c.GotToken {
+		return
+	}
 
-		if match != nil {
-			//Dump the potentials
-			delete(pending, token)
+	lock.Lock()
+	defer lock.Unlock()
 
-			//start connection
-			match.Client.connectWith(c)
-			c.connectWith(match.Client)
+	potentials, ok := pending[c.Token]
+	if !ok {
+		return
+	}
+
+	remaining := potentials[:0]
+	for _, p := range potentials {
+		if p.Client != c {
+			remaining = append(remaining, p)
 		}
 	}
 
-	pending[token] = []transitConn{
-		transitConn{
-			Side:   side,
-			Client: c,
-		},
+	if len(remaining) == 0 {
+		delete(pending, c.Token)
+	} else {
+		pending[c.Token] = remaining
 	}
 }
 
-func (c *Client) connectWith(other *Client) {
-	c.Mood = "happy"
+//connectWith pairs this client to the other one sharing the session,
+//must be called while holding the pending lock
+func (c *Client) connectWith(other *Client, sess *session) {
+	c.Mood = MoodHappy
 	c.Buddy = other
+	c.session = sess
+	c.addrLimiter = acquireAddressLimiter(c.conn.RemoteAddr())
+
+	//No more waiting on a partner
+	c.conn.SetReadDeadline(time.Time{})
 
 	c.conn.Write([]byte("ok\n"))
 	c.SentOK = true
 }
+
+//throttle counts the bytes against the session cap, and blocks
+//until the bandwidth limits allow them through
+func (c *Client) throttle(n int) error {
+	if err := c.session.add(n); err != nil {
+		return err
+	}
+
+	c.session.limiter.wait(n)
+	c.addrLimiter.wait(n)
+	globalLimiter.wait(n)
+
+	return nil
+}
+
+//isPaired returns true once the OK has been sent
+//and data should be piped to the buddy
+func (c *Client) isPaired() bool {
+	lock.Lock()
+	defer lock.Unlock()
+
+	return c.SentOK
+}
+
+//mood returns the mood to record for the client, which is
+//capped for both clients once their session passed the cap
+func (c *Client) mood() string {
+	if c.session != nil && c.session.isCapped() {
+		return MoodCapped
+	}
+	return c.Mood
+}
+
+func (c *Client) isClosed() bool {
+	c.closeLock.Lock()
+	defer c.closeLock.Unlock()
+
+	return c.closed
+}
+
+//setDeadline sets the read deadline for the connection
+//a duration from now, or clears it if the duration is 0
+func (c *Client) setDeadline(dur time.Duration) {
+	if dur > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(dur))
+	} else {
+		c.conn.SetReadDeadline(time.Time{})
+	}
+}
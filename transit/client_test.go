@@ -0,0 +1,210 @@
+package transit
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//testConn is a net.Conn stand-in that records what
+//the transit client does with it
+type testConn struct {
+	net.Conn
+
+	lock    sync.Mutex
+	written []byte
+	closed  bool
+}
+
+func (c *testConn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.written = append(c.written, b...)
+	return len(b), nil
+}
+
+func (c *testConn) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *testConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func (c *testConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+var (
+	tokenA = strings.Repeat("a", 64)
+	tokenB = strings.Repeat("b", 64)
+
+	side1 = strings.Repeat("1", 16)
+	side2 = strings.Repeat("2", 16)
+	side3 = strings.Repeat("3", 16)
+)
+
+type handshake struct {
+	token string
+	side  string
+}
+
+func TestPairing(t *testing.T) {
+	tests := []struct {
+		name       string
+		handshakes []handshake
+
+		//pairs lists the indexes of handshakes expected to be buddies
+		pairs [][2]int
+		//redundant lists the indexes expected to be dropped as spares
+		redundant []int
+		//waiting is the number of clients expected to remain pending
+		waiting int
+	}{
+		{
+			name:       "different sides pair",
+			handshakes: []handshake{{tokenA, side1}, {tokenA, side2}},
+			pairs:      [][2]int{{0, 1}},
+		},
+		{
+			name:       "same side does not pair",
+			handshakes: []handshake{{tokenA, side1}, {tokenA, side1}},
+			waiting:    2,
+		},
+		{
+			name:       "different tokens do not pair",
+			handshakes: []handshake{{tokenA, side1}, {tokenB, side2}},
+			waiting:    2,
+		},
+		{
+			name:       "old style tokens pair",
+			handshakes: []handshake{{tokenA, ""}, {tokenA, ""}},
+			pairs:      [][2]int{{0, 1}},
+		},
+		{
+			name:       "old style pairs with new style",
+			handshakes: []handshake{{tokenA, ""}, {tokenA, side1}},
+			pairs:      [][2]int{{0, 1}},
+		},
+		{
+			name:       "new style pairs with old style",
+			handshakes: []handshake{{tokenA, side1}, {tokenA, ""}},
+			pairs:      [][2]int{{0, 1}},
+		},
+		{
+			name:       "oldest same side connection wins",
+			handshakes: []handshake{{tokenA, side1}, {tokenA, side1}, {tokenA, side2}},
+			pairs:      [][2]int{{0, 2}},
+			redundant:  []int{1},
+		},
+		{
+			name:       "extra connections are closed as redundant",
+			handshakes: []handshake{{tokenA, side1}, {tokenA, side1}, {tokenA, side1}, {tokenA, side2}},
+			pairs:      [][2]int{{0, 3}},
+			redundant:  []int{1, 2},
+		},
+		{
+			name:       "token is used up after pairing",
+			handshakes: []handshake{{tokenA, side1}, {tokenA, side2}, {tokenA, side3}},
+			pairs:      [][2]int{{0, 1}},
+			waiting:    1,
+		},
+		{
+			name:       "third side pairs with the oldest",
+			handshakes: []handshake{{tokenA, side1}, {tokenA, side1}, {tokenA, side3}, {tokenA, side2}},
+			pairs:      [][2]int{{0, 2}},
+			redundant:  []int{1},
+			waiting:    1,
+		},
+		{
+			name: "tokens pair independently",
+			handshakes: []handshake{
+				{tokenA, side1}, {tokenB, side1},
+				{tokenB, side2}, {tokenA, side2},
+			},
+			pairs: [][2]int{{0, 3}, {1, 2}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			pending = make(map[string][]transitConn)
+
+			clients := make([]*Client, len(tc.handshakes))
+			for i, hs := range tc.handshakes {
+				clients[i] = NewClient(&testConn{})
+				clients[i].processToken(hs.token, hs.side)
+			}
+
+			expected := make(map[int]int)
+			for _, p := range tc.pairs {
+				expected[p[0]] = p[1]
+				expected[p[1]] = p[0]
+			}
+			redundant := make(map[int]bool)
+			for _, r := range tc.redundant {
+				redundant[r] = true
+			}
+
+			for i, c := range clients {
+				conn := c.conn.(*testConn)
+
+				if buddy, ok := expected[i]; ok {
+					if c.Buddy != clients[buddy] {
+						t.Errorf("client %d expected to pair with %d", i, buddy)
+					}
+					if c.Mood != MoodHappy || !c.SentOK || string(conn.written) != "ok\n" {
+						t.Errorf("client %d was not told it was paired", i)
+					}
+				} else if redundant[i] {
+					if c.Mood != MoodRedundant || !conn.closed || !c.isClosed() {
+						t.Errorf("client %d expected to be dropped as redundant", i)
+					}
+				} else {
+					if c.Buddy != nil || c.Mood != MoodLonely || conn.closed {
+						t.Errorf("client %d expected to still be waiting", i)
+					}
+				}
+			}
+
+			waiting := 0
+			for _, potentials := range pending {
+				waiting += len(potentials)
+			}
+			if waiting != tc.waiting {
+				t.Errorf("expected %d waiting clients, found %d", tc.waiting, waiting)
+			}
+		})
+	}
+}
+
+func TestPendingRemovedOnClose(t *testing.T) {
+	pending = make(map[string][]transitConn)
+
+	first := NewClient(&testConn{})
+	first.processToken(tokenA, side1)
+	second := NewClient(&testConn{})
+	second.processToken(tokenA, side1)
+
+	first.Close()
+	if len(pending[tokenA]) != 1 || pending[tokenA][0].Client != second {
+		t.Error("closing a waiting client should only remove it from pending")
+	}
+
+	second.Close()
+	if _, ok := pending[tokenA]; ok {
+		t.Error("closing the last waiting client should remove the token")
+	}
+
+	//A closed client should not be paired with
+	third := NewClient(&testConn{})
+	third.processToken(tokenA, side2)
+	if third.Buddy != nil {
+		t.Error("paired with a client that already closed")
+	}
+}
@@ -0,0 +1,34 @@
+package transit
+
+import (
+	"net"
+	"sync"
+)
+
+//HandshakeCheck decides if a client that sent a valid handshake
+//from the address may be paired. The side is not given, as clients
+//pick their transit side apart from their relay side, so the relay
+//has nothing to match it against
+type HandshakeCheck func(addr net.IP) bool
+
+var (
+	handshakeCheck     HandshakeCheck
+	lockHandshakeCheck sync.RWMutex
+)
+
+//SetHandshakeCheck installs the check every handshake must pass
+//before being paired. Passing nil accepts all handshakes, which is
+//the default
+func SetHandshakeCheck(check HandshakeCheck) {
+	lockHandshakeCheck.Lock()
+	handshakeCheck = check
+	lockHandshakeCheck.Unlock()
+}
+
+//handshakeAllowed runs the installed check, if there is one
+func handshakeAllowed(addr net.IP) bool {
+	lockHandshakeCheck.RLock()
+	defer lockHandshakeCheck.RUnlock()
+
+	return handshakeCheck == nil || handshakeCheck(addr)
+}
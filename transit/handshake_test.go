@@ -0,0 +1,47 @@
+package transit
+
+import (
+	"net"
+	"testing"
+)
+
+func TestHandshakeCheck(t *testing.T) {
+	pending = make(map[string][]transitConn)
+
+	var allowed, checked net.IP
+	SetHandshakeCheck(func(addr net.IP) bool {
+		checked = addr
+		return addr.Equal(allowed)
+	})
+	defer SetHandshakeCheck(nil)
+
+	refused := NewClient(&testConn{})
+	if err := refused.handleData([]byte("please relay " + tokenA + " for side " + side1 + "\n")); err == nil {
+		t.Error("expected the unknown address to be refused")
+	}
+	if string(refused.conn.(*testConn).written) != "bad handshake\n" {
+		t.Error("refused client was not told")
+	}
+	if !checked.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("check was given address %s", checked)
+	}
+	if len(pending[tokenA]) != 0 {
+		t.Error("refused client should not be waiting")
+	}
+
+	allowed = net.IPv4(127, 0, 0, 1)
+	accepted := NewClient(&testConn{})
+	if err := accepted.handleData([]byte("please relay " + tokenA + " for side " + side1 + "\n")); err != nil {
+		t.Error(err)
+	}
+	if len(pending[tokenA]) != 1 {
+		t.Error("accepted client should be waiting")
+	}
+
+	//Old style handshakes are checked the same way
+	allowed = nil
+	old := NewClient(&testConn{})
+	if err := old.handleData([]byte("please relay " + tokenB + "\n")); err == nil {
+		t.Error("expected the old handshake from an unknown address to be refused")
+	}
+}
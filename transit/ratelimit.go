@@ -0,0 +1,172 @@
+package transit
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+//ErrSessionCap is returned when a session has piped more
+//than the configured maximum amount of bytes
+var ErrSessionCap = errors.New("transit session reached the byte cap")
+
+var (
+	sessionRate  uint
+	sessionBytes uint
+	addressRate  uint
+
+	globalLimiter *rateLimiter
+
+	addressLimiters map[string]*addressLimiter
+	lockAddresses   sync.Mutex
+)
+
+//rateLimiter is a token bucket limiting the amount of bytes per
+//second. It allows bursts of up to one second worth of bytes
+type rateLimiter struct {
+	lock   sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+//newRateLimiter returns a limiter for the bytes per second rate,
+//or nil if the rate is 0 (unlimited)
+func newRateLimiter(rate uint) *rateLimiter {
+	if rate == 0 {
+		return nil
+	}
+
+	return &rateLimiter{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+//wait blocks until n bytes are allowed through the limiter.
+//A nil limiter never blocks
+func (r *rateLimiter) wait(n int) {
+	if r == nil {
+		return
+	}
+
+	r.lock.Lock()
+	now := time.Now()
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.rate {
+		r.tokens = r.rate
+	}
+	r.last = now
+
+	//Take the bytes now, if that puts us in debt then
+	//we wait for it to be paid off
+	r.tokens -= float64(n)
+	var delay time.Duration
+	if r.tokens < 0 {
+		delay = time.Duration(-r.tokens / r.rate * float64(time.Second))
+	}
+	r.lock.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+//addressLimiter is a rate limiter shared by all the
+//connections from a single IP address
+type addressLimiter struct {
+	limiter *rateLimiter
+	refs    int
+}
+
+//acquireAddressLimiter returns the shared limiter for the address,
+//creating it if needed. Returns nil if address limiting is off.
+//Each call must be matched with a releaseAddressLimiter
+func acquireAddressLimiter(addr net.Addr) *rateLimiter {
+	if addressRate == 0 || addr == nil {
+		return nil
+	}
+
+	host := addressHost(addr)
+
+	lockAddresses.Lock()
+	defer lockAddresses.Unlock()
+
+	al, ok := addressLimiters[host]
+	if !ok {
+		al = &addressLimiter{
+			limiter: newRateLimiter(addressRate),
+		}
+		addressLimiters[host] = al
+	}
+	al.refs++
+
+	return al.limiter
+}
+
+//releaseAddressLimiter drops a reference to the shared limiter
+//for the address, and frees it when nobody is using it
+func releaseAddressLimiter(addr net.Addr) {
+	if addressRate == 0 || addr == nil {
+		return
+	}
+
+	host := addressHost(addr)
+
+	lockAddresses.Lock()
+	defer lockAddresses.Unlock()
+
+	if al, ok := addressLimiters[host]; ok {
+		al.refs--
+		if al.refs <= 0 {
+			delete(addressLimiters, host)
+		}
+	}
+}
+
+func addressHost(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+//session holds the state shared between two paired clients
+type session struct {
+	limiter *rateLimiter
+
+	lock   sync.Mutex
+	bytes  uint
+	capped bool
+}
+
+func newSession() *session {
+	return &session{
+		limiter: newRateLimiter(sessionRate),
+	}
+}
+
+//add counts the bytes against the session cap, returning
+//ErrSessionCap if the cap has been passed
+func (s *session) add(n int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.bytes += uint(n)
+	if sessionBytes > 0 && s.bytes > sessionBytes {
+		s.capped = true
+		return ErrSessionCap
+	}
+	return nil
+}
+
+//isCapped returns true once either client has passed the session cap
+func (s *session) isCapped() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.capped
+}
@@ -0,0 +1,119 @@
+package transit
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var unlimited *rateLimiter
+	start := time.Now()
+	unlimited.wait(1 << 20)
+	if time.Since(start) > 10*time.Millisecond {
+		t.Error("nil limiter should not block")
+	}
+
+	limiter := newRateLimiter(10000)
+
+	//First second worth is a burst
+	start = time.Now()
+	limiter.wait(10000)
+	if time.Since(start) > 10*time.Millisecond {
+		t.Error("limiter should allow a burst of its rate")
+	}
+
+	//Then we should be waiting for the bucket to refill
+	start = time.Now()
+	limiter.wait(2000)
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > 400*time.Millisecond {
+		t.Errorf("expected to wait around 200ms, waited %s", elapsed)
+	}
+}
+
+func TestAddressLimiterShared(t *testing.T) {
+	addressRate = 1000
+	addressLimiters = make(map[string]*addressLimiter)
+	defer func() {
+		addressRate = 0
+	}()
+
+	conn := &testConn{}
+	first := acquireAddressLimiter(conn.RemoteAddr())
+	second := acquireAddressLimiter(conn.RemoteAddr())
+	if first == nil || first != second {
+		t.Error("connections from the same address should share a limiter")
+	}
+
+	releaseAddressLimiter(conn.RemoteAddr())
+	releaseAddressLimiter(conn.RemoteAddr())
+	if len(addressLimiters) != 0 {
+		t.Error("address limiter should be freed after the last release")
+	}
+}
+
+func TestSessionCap(t *testing.T) {
+	pending = make(map[string][]transitConn)
+	sessionBytes = 10
+	defer func() {
+		sessionBytes = 0
+	}()
+
+	sender := NewClient(&testConn{})
+	sender.processToken(tokenA, side1)
+	receiver := NewClient(&testConn{})
+	receiver.processToken(tokenA, side2)
+
+	if err := sender.handleData([]byte("12345")); err != nil {
+		t.Error(err)
+	}
+	if err := receiver.handleData([]byte("12345")); err != nil {
+		t.Error(err)
+	}
+
+	if err := sender.handleData([]byte("6")); err != ErrSessionCap {
+		t.Error("expected the session to be capped")
+	}
+	if sender.mood() != MoodCapped || receiver.mood() != MoodCapped {
+		t.Error("expected both sides to be recorded as capped")
+	}
+
+	received := string(receiver.conn.(*testConn).written)
+	if received != "ok\n12345" {
+		t.Errorf("expected only the data within the cap to be piped, got %q", received)
+	}
+}
+
+func TestSessionCapBothSides(t *testing.T) {
+	pending = make(map[string][]transitConn)
+	sessionBytes = 1 << 16
+	defer func() {
+		sessionBytes = 0
+	}()
+
+	first := NewClient(&testConn{})
+	first.processToken(tokenA, side1)
+	second := NewClient(&testConn{})
+	second.processToken(tokenA, side2)
+
+	//Each client sends from its own goroutine, as they do when
+	//reading from their connections, until the cap stops them
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, c := range []*Client{first, second} {
+		wg.Add(1)
+		go func(c *Client) {
+			defer wg.Done()
+			<-start
+			for c.handleData([]byte("12345")) == nil {
+			}
+			c.Close()
+		}(c)
+	}
+	close(start)
+	wg.Wait()
+
+	if first.mood() != MoodCapped || second.mood() != MoodCapped {
+		t.Error("expected both sides to be recorded as capped")
+	}
+}
@@ -2,20 +2,53 @@ package transit
 
 import (
 	"context"
+	"fmt"
 	"net"
+	"net/http"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/chris-pikul/go-wormhole-server/config"
 	"github.com/chris-pikul/go-wormhole-server/log"
+	"github.com/chris-pikul/go-wormhole-server/remote"
 )
 
 var (
 	addr   string
 	server net.Listener
 
+	wsServer *http.Server
+
 	lock    sync.Mutex
 	pending map[string][]transitConn
+
+	handshakeTimeout time.Duration
+	lonelyTimeout    time.Duration
+
+	trustedProxies remote.Networks
+)
+
+const (
+	//MoodHappy is recorded for clients that were paired
+	//and piped through to their partner
+	MoodHappy = "happy"
+
+	//MoodLonely is recorded for clients that sent a valid
+	//handshake but never got a partner
+	MoodLonely = "lonely"
+
+	//MoodErrory is recorded for clients that never completed
+	//a valid handshake
+	MoodErrory = "errory"
+
+	//MoodRedundant is recorded for clients that were dropped
+	//because another connection took their place
+	MoodRedundant = "redundant"
+
+	//MoodCapped is recorded for sessions that were closed
+	//for piping more than the session byte cap
+	MoodCapped = "capped"
 )
 
 type transitConn struct {
@@ -34,20 +67,58 @@ func Initialize() error {
 
 	addr = net.JoinHostPort(config.Opts.Transit.Host, strconv.Itoa(int(config.Opts.Transit.Port)))
 
+	var err error
+	trustedProxies, err = remote.ParseNetworks(config.Opts.Transit.TrustedProxies)
+	if err != nil {
+		return err
+	}
+
+	err = SetAccessLists(config.Opts.Transit.AllowNetworks, config.Opts.Transit.DenyNetworks)
+	if err != nil {
+		return err
+	}
+
 	pending = make(map[string][]transitConn, 0)
 
+	if config.Opts.Transit.WebsocketPort > 0 {
+		router := http.NewServeMux()
+		router.HandleFunc("/", handleWebsocket)
+
+		wsServer = &http.Server{
+			Addr:    fmt.Sprintf("%s:%d", config.Opts.Transit.Host, config.Opts.Transit.WebsocketPort),
+			Handler: router,
+		}
+	}
+
+	handshakeTimeout = time.Second * time.Duration(config.Opts.Transit.HandshakeTimeout)
+	lonelyTimeout = time.Second * time.Duration(config.Opts.Transit.LonelyTimeout)
+
+	sessionRate = config.Opts.Transit.SessionRate
+	sessionBytes = config.Opts.Transit.SessionBytes
+	addressRate = config.Opts.Transit.AddressRate
+	globalLimiter = newRateLimiter(config.Opts.Transit.GlobalRate)
+	addressLimiters = make(map[string]*addressLimiter)
+
 	return nil
 }
 
 //Shutdown gracefully closes the transit connections.
 //Returns an error if something failed along the way.
 func Shutdown(ctx context.Context) error {
+	var err error
+
 	if server != nil {
 		server.Close()
 	}
 	server = nil
 
-	return nil
+	if wsServer != nil {
+		err = wsServer.Shutdown(ctx)
+		log.Info("shutdown transit websocket server")
+	}
+	wsServer = nil
+
+	return err
 }
 
 //Start begins the actually listening server and
@@ -64,8 +135,33 @@ func Start() error {
 		return err
 	}
 
+	if config.Opts.Transit.ProxyProtocol {
+		log.Info("transit server expecting PROXY protocol headers")
+		server = remote.NewListener(server, trustedProxies)
+	}
+
 	go runTransit()
 
+	if wsServer != nil {
+		wsListener, err := net.Listen("tcp", wsServer.Addr)
+		if err != nil {
+			return err
+		}
+
+		if config.Opts.Transit.ProxyProtocol {
+			wsListener = remote.NewListener(wsListener, trustedProxies)
+		}
+
+		go func() {
+			log.Infof("starting transit websocket server on %s", wsServer.Addr)
+			err := wsServer.Serve(wsListener)
+			if err != nil && err != http.ErrServerClosed {
+				log.Err("closing transit websocket server encountered an error", err)
+			}
+			log.Info("transit websocket server closed")
+		}()
+	}
+
 	return nil
 }
 
@@ -82,6 +178,14 @@ func runTransit() {
 }
 
 func handleConnection(c net.Conn) {
+	//Checked here instead of the accept loop, as reading a
+	//PROXY header for the real address may block
+	if !AddressAllowed(remote.HostIP(c.RemoteAddr())) {
+		log.Infof("refusing tcp connection from denied network: %s", c.RemoteAddr().String())
+		c.Close()
+		return
+	}
+
 	log.Infof("serving tcp connection: %s", c.RemoteAddr().String())
 
 	client := NewClient(c)
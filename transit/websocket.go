@@ -0,0 +1,145 @@
+package transit
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/chris-pikul/go-wormhole-server/log"
+	"github.com/chris-pikul/go-wormhole-server/remote"
+	"github.com/gorilla/websocket"
+)
+
+//ErrTextFrame is returned when a websocket transit client sends
+//a text frame, all transit data must be sent as binary frames
+var ErrTextFrame = errors.New("transit websocket messages must be binary")
+
+var upgrader = websocket.Upgrader{
+	HandshakeTimeout: time.Minute,
+
+	ReadBufferSize:  pipeBufferSize,
+	WriteBufferSize: pipeBufferSize,
+
+	//Browser clients may be served from anywhere
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+func handleWebsocket(w http.ResponseWriter, r *http.Request) {
+	if !AddressAllowed(remote.ParseHostIP(r.RemoteAddr)) {
+		log.Infof("refusing websocket connection from denied network: %s", r.RemoteAddr)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Warnf("upgrading transit connection to websocket failed: %s", err.Error())
+		return
+	}
+
+	log.Infof("serving websocket connection: %s", ws.RemoteAddr().String())
+
+	client := NewClient(newWebsocketConn(ws))
+	defer client.Close()
+
+	client.HandleConnection()
+}
+
+//websocketConn adapts a websocket connection into a net.Conn
+//so that websocket clients can be handled, and paired, the same
+//as TCP clients. The binary frames are treated as one continuous
+//byte stream in both directions
+type websocketConn struct {
+	ws     *websocket.Conn
+	reader io.Reader
+
+	writeLock sync.Mutex
+}
+
+func newWebsocketConn(ws *websocket.Conn) *websocketConn {
+	return &websocketConn{
+		ws: ws,
+	}
+}
+
+//Read reads from the current binary frame, moving on
+//to the next one when it is exhausted
+func (c *websocketConn) Read(b []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			mt, r, err := c.ws.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+
+			if mt != websocket.BinaryMessage {
+				return 0, ErrTextFrame
+			}
+			c.reader = r
+		}
+
+		n, err := c.reader.Read(b)
+		if err == io.EOF {
+			//End of this frame, not the connection
+			c.reader = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+//Write sends the data as a single binary frame
+func (c *websocketConn) Write(b []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+//Close sends the closing frame and shuts down the connection
+func (c *websocketConn) Close() error {
+	c.writeLock.Lock()
+	c.ws.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(time.Second))
+	c.writeLock.Unlock()
+
+	return c.ws.Close()
+}
+
+func (c *websocketConn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+func (c *websocketConn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+func (c *websocketConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *websocketConn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+func (c *websocketConn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}
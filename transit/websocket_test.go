@@ -0,0 +1,106 @@
+package transit
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebsocketPairsWithTCP(t *testing.T) {
+	pending = make(map[string][]transitConn)
+
+	//TCP side of the transit
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpListener.Close()
+	go func() {
+		for {
+			c, err := tcpListener.Accept()
+			if err != nil {
+				return
+			}
+			go handleConnection(c)
+		}
+	}()
+
+	//Websocket side of the transit
+	wsListener := httptest.NewServer(http.HandlerFunc(handleWebsocket))
+	defer wsListener.Close()
+
+	browser, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(wsListener.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer browser.Close()
+
+	cli, err := net.Dial("tcp", tcpListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	err = browser.WriteMessage(websocket.BinaryMessage, []byte("please relay "+tokenA+" for side "+side1+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Wait for the websocket side to be pending before the other arrives
+	time.Sleep(50 * time.Millisecond)
+	cli.Write([]byte("please relay " + tokenA + " for side " + side2 + "\n"))
+
+	cli.SetReadDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(cli)
+	line, err := reader.ReadString('\n')
+	if err != nil || line != "ok\n" {
+		t.Fatalf("tcp side expected ok, got %q (%v)", line, err)
+	}
+
+	browser.SetReadDeadline(time.Now().Add(time.Second))
+	mt, data, err := browser.ReadMessage()
+	if err != nil || mt != websocket.BinaryMessage || string(data) != "ok\n" {
+		t.Fatalf("websocket side expected ok, got %q (%v)", data, err)
+	}
+
+	//Browser sends to CLI, split over multiple frames
+	browser.WriteMessage(websocket.BinaryMessage, []byte("hello "))
+	browser.WriteMessage(websocket.BinaryMessage, []byte("cli\n"))
+	line, err = reader.ReadString('\n')
+	if err != nil || line != "hello cli\n" {
+		t.Fatalf("tcp side expected piped data, got %q (%v)", line, err)
+	}
+
+	//CLI sends to browser
+	cli.Write([]byte("hello browser"))
+	_, data, err = browser.ReadMessage()
+	if err != nil || string(data) != "hello browser" {
+		t.Fatalf("websocket side expected piped data, got %q (%v)", data, err)
+	}
+}
+
+func TestWebsocketRejectsText(t *testing.T) {
+	pending = make(map[string][]transitConn)
+
+	server := httptest.NewServer(http.HandlerFunc(handleWebsocket))
+	defer server.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	ws.WriteMessage(websocket.TextMessage, []byte("please relay "+tokenA+" for side "+side1+"\n"))
+
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := ws.ReadMessage(); err == nil {
+		t.Error("expected the connection to be closed for a text frame")
+	}
+}